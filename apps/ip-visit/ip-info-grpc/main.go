@@ -5,10 +5,15 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os/signal"
+	"syscall"
+	"time"
 
 	pb "github.com/metalbear-co/playground/protogen"
 	"github.com/spf13/viper"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 var ctx = context.Background()
@@ -20,23 +25,33 @@ type Config struct {
 	KafkaAddress       string
 	KafkaTopic         string
 	KafkaConsumerGroup string
+	// ShutdownTimeout bounds how long in-flight requests get on SIGTERM.
+	ShutdownTimeout time.Duration
 }
 
+// IpInfo
+// Tags drive the counter's tag policy, e.g. "blocked", "internal" or "bot"
 type IpInfo struct {
-	Ip   string `json:"ip"`
-	Info string `json:"name"`
+	Ip   string   `json:"ip"`
+	Info string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
 }
 
 // albums slice to seed record album data.
 var ipInfos = []IpInfo{
-	{Ip: "84.229.14.82", Info: "Aviram, Loves coffee!"},
+	{Ip: "84.229.14.82", Info: "Aviram, Loves coffee!", Tags: []string{"internal"}},
+	{Ip: "192.0.2.66", Info: "Known scraper", Tags: []string{"bot"}},
+	{Ip: "198.51.100.13", Info: "Abusive client", Tags: []string{"blocked"}},
 }
 
 func loadConfig() Config {
 	viper.BindEnv("port")
+	viper.BindEnv("shutdowntimeout")
+	viper.SetDefault("shutdowntimeout", "20s")
 
 	config := Config{}
 	config.Port = int16(viper.GetInt("port"))
+	config.ShutdownTimeout = viper.GetDuration("shutdowntimeout")
 	return config
 }
 
@@ -49,7 +64,7 @@ func (s *server) GetIpInfo(ctx context.Context, req *pb.IpRequest) (*pb.IpRespon
 
 	for _, info := range ipInfos {
 		if info.Ip == ip {
-			return &pb.IpResponse{Ip: info.Ip, Info: info.Info}, nil
+			return &pb.IpResponse{Ip: info.Ip, Info: info.Info, Tags: info.Tags}, nil
 		}
 	}
 	return &pb.IpResponse{Ip: ip, Info: "Unknown"}, nil
@@ -65,9 +80,35 @@ func main() {
 
 	s := grpc.NewServer()
 	pb.RegisterIpInfoServiceServer(s, &server{})
+	// Kubelet probes the standard gRPC health service on the same port.
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(s, healthServer)
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
 
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			log.Fatalf("failed to serve: %v", err)
+		}
+	}()
 	fmt.Printf("gRPC server listening on port %d\n", config.Port)
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+
+	shutdown, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-shutdown.Done()
+	log.Print("shutting down")
+	// Report NOT_SERVING so no new traffic is routed here while draining.
+	healthServer.Shutdown()
+
+	// GracefulStop waits for in-flight RPCs; fall back to Stop after the timeout.
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(config.ShutdownTimeout):
+		log.Print("timed out waiting for in-flight requests")
+		s.Stop()
 	}
 }
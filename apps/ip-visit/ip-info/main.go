@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
@@ -18,23 +23,33 @@ type Config struct {
 	KafkaAddress       string
 	KafkaTopic         string
 	KafkaConsumerGroup string
+	// ShutdownTimeout bounds how long in-flight requests get on SIGTERM.
+	ShutdownTimeout time.Duration
 }
 
+// IpInfo
+// Tags drive the counter's tag policy, e.g. "blocked", "internal" or "bot"
 type IpInfo struct {
-	Ip   string `json:"ip"`
-	Info string `json:"name"`
+	Ip   string   `json:"ip"`
+	Info string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
 }
 
 // albums slice to seed record album data.
 var ipInfos = []IpInfo{
-	{Ip: "84.229.14.82", Info: "Aviram, Loves coffee!"},
+	{Ip: "84.229.14.82", Info: "Aviram, Loves coffee!", Tags: []string{"internal"}},
+	{Ip: "192.0.2.66", Info: "Known scraper", Tags: []string{"bot"}},
+	{Ip: "198.51.100.13", Info: "Abusive client", Tags: []string{"blocked"}},
 }
 
 func loadConfig() Config {
 	viper.BindEnv("port")
+	viper.BindEnv("shutdowntimeout")
+	viper.SetDefault("shutdowntimeout", "20s")
 
 	config := Config{}
 	config.Port = int16(viper.GetInt("port"))
+	config.ShutdownTimeout = viper.GetDuration("shutdowntimeout")
 	return config
 }
 
@@ -57,7 +72,25 @@ func main() {
 
 	router := gin.Default()
 	router.GET("/health", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+	// No dependencies, so ready as long as it serves.
+	router.GET("/livez", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, gin.H{"status": "ok"}) })
+	router.GET("/readyz", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, gin.H{"status": "ok"}) })
 	router.GET("/ip/:ip", getIpInfo)
+	server := &http.Server{Addr: "0.0.0.0:" + fmt.Sprint(config.Port), Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
 	fmt.Print("loaded")
-	router.Run("0.0.0.0:" + fmt.Sprint(config.Port))
+
+	shutdown, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-shutdown.Done()
+	log.Print("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(ctx, config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to finish in-flight requests: %v", err)
+	}
 }
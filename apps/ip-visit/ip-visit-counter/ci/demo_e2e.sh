@@ -4,11 +4,23 @@ set -euo pipefail
 : "${PLAYGROUND_URL:?Need PLAYGROUND_URL (e.g. http://localhost:30080 or https://playground.metalbear.dev)}"
 : "${DEMO_TENANT:?Need DEMO_TENANT (e.g. mirrord-ci-demo)}"
 
-echo "Hitting ${PLAYGROUND_URL}/count with tenant=${DEMO_TENANT}"
+echo "Recording a visit at ${PLAYGROUND_URL}/visits with tenant=${DEMO_TENANT}"
 
-resp="$(curl -sS -H "X-PG-Tenant: ${DEMO_TENANT}" "${PLAYGROUND_URL}/count")"
+# GET /count is read-only; POST /visits is what counts. A fresh key per run,
+# so a retried curl replays the visit instead of counting it twice.
+idempotency_key="demo-e2e-$(date +%s)-$$"
+resp="$(curl -sS -X POST \
+	-H "X-PG-Tenant: ${DEMO_TENANT}" \
+	-H "Idempotency-Key: ${idempotency_key}" \
+	"${PLAYGROUND_URL}/visits")"
 echo "$resp" | jq .
 
+# Assert: the visit was counted
+echo "$resp" | jq -e '.count | type == "number" and . >= 1' >/dev/null || {
+	echo "❌ ERROR: count field missing or visit not counted"
+	exit 1
+}
+
 # Assert: unique_ips exists and is a number
 echo "$resp" | jq -e '.unique_ips | type == "number"' >/dev/null || {
 	echo "❌ ERROR: unique_ips field missing or not a number"
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header sources the client IP can be resolved from, in CLIENTIPHEADERS.
+const (
+	ClientIpSourceRemoteAddr    = "remote-addr"
+	ClientIpSourceForwarded     = "forwarded"
+	ClientIpSourceXRealIp       = "x-real-ip"
+	ClientIpSourceXForwardedFor = "x-forwarded-for"
+)
+
+// ClientIpResolver
+// Resolves the visitor IP from the connection and proxy headers. Headers are
+// only honored when the direct peer is one of the trusted proxies.
+type ClientIpResolver struct {
+	TrustedProxies []netip.Prefix
+	Headers        []string
+	// Depth, when > 0, picks the Nth address from the right of a Forwarded /
+	// X-Forwarded-For chain (the number of proxies that append to it). When 0
+	// the chain is walked from the right, skipping trusted proxies.
+	Depth int
+}
+
+// ClientIpResolution
+// The resolved IP and the chain it was picked from, client first
+type ClientIpResolution struct {
+	Ip     string   `json:"ip"`
+	Source string   `json:"source"`
+	Chain  []string `json:"chain"`
+}
+
+var ClientIp = &ClientIpResolver{}
+
+// SetupClientIp
+// Parse trusted proxy CIDRs and header preferences from config
+func SetupClientIp(trustedProxies, headers string, depth int) error {
+	resolver := &ClientIpResolver{Depth: depth}
+	for _, entry := range splitList(trustedProxies) {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		resolver.TrustedProxies = append(resolver.TrustedProxies, prefix)
+	}
+	for _, header := range splitList(headers) {
+		header = strings.ToLower(header)
+		switch header {
+		case ClientIpSourceForwarded, ClientIpSourceXRealIp, ClientIpSourceXForwardedFor:
+			resolver.Headers = append(resolver.Headers, header)
+		default:
+			return fmt.Errorf("unsupported client IP header %q", header)
+		}
+	}
+	ClientIp = resolver
+	return nil
+}
+
+func splitList(value string) []string {
+	var out []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if !prefix.Addr().Is4In6() {
+			return prefix.Masked(), nil
+		}
+		// An IPv4-mapped range like ::ffff:198.51.100.0/120 is the IPv4 /24,
+		// since addresses are unmapped before they are matched.
+		if prefix.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("IPv4-mapped prefix %s is wider than ::ffff:0:0/96", value)
+		}
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96).Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseIp accepts the address forms found in proxy headers: bare addresses,
+// host:port, bracketed IPv6 with or without a port, and quoted values. IPv4-mapped
+// IPv6 addresses are normalized to plain IPv4.
+func parseIp(value string) (netip.Addr, bool) {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+func (r *ClientIpResolver) trusted(addr netip.Addr) bool {
+	for _, prefix := range r.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve
+// Determine the client IP for a request
+func (r *ClientIpResolver) Resolve(req *http.Request) ClientIpResolution {
+	remote, ok := parseIp(req.RemoteAddr)
+	if !ok {
+		return ClientIpResolution{Ip: req.RemoteAddr, Source: ClientIpSourceRemoteAddr, Chain: []string{req.RemoteAddr}}
+	}
+	direct := ClientIpResolution{Ip: remote.String(), Source: ClientIpSourceRemoteAddr, Chain: []string{remote.String()}}
+	if !r.trusted(remote) {
+		return direct
+	}
+
+	for _, header := range r.Headers {
+		var chain []netip.Addr
+		switch header {
+		case ClientIpSourceXRealIp:
+			if addr, ok := parseIp(req.Header.Get("X-Real-Ip")); ok {
+				return ClientIpResolution{Ip: addr.String(), Source: header, Chain: []string{addr.String(), remote.String()}}
+			}
+			continue
+		case ClientIpSourceForwarded:
+			chain = forwardedChain(req.Header.Values("Forwarded"))
+		case ClientIpSourceXForwardedFor:
+			chain = xForwardedForChain(req.Header.Values("X-Forwarded-For"))
+		}
+		if len(chain) == 0 {
+			continue
+		}
+		// The direct peer is the last hop of the chain.
+		chain = append(chain, remote)
+		return ClientIpResolution{Ip: r.pick(chain).String(), Source: header, Chain: addrStrings(chain)}
+	}
+	return direct
+}
+
+// pick selects the client from a chain ordered client first, direct peer last.
+func (r *ClientIpResolver) pick(chain []netip.Addr) netip.Addr {
+	if r.Depth > 0 {
+		// The direct peer is appended to the chain, so depth N lands N+1 from the end.
+		idx := len(chain) - 1 - r.Depth
+		if idx < 0 {
+			idx = 0
+		}
+		return chain[idx]
+	}
+	for i := len(chain) - 1; i > 0; i-- {
+		if !r.trusted(chain[i]) {
+			return chain[i]
+		}
+	}
+	return chain[0]
+}
+
+func xForwardedForChain(values []string) []netip.Addr {
+	var chain []netip.Addr
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			addr, ok := parseIp(entry)
+			if !ok {
+				// A malformed hop makes everything left of it untrustworthy.
+				chain = nil
+				continue
+			}
+			chain = append(chain, addr)
+		}
+	}
+	return chain
+}
+
+// forwardedChain extracts the for= parameters of an RFC 7239 Forwarded header.
+func forwardedChain(values []string) []netip.Addr {
+	var chain []netip.Addr
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if !found || !strings.EqualFold(key, "for") {
+					continue
+				}
+				addr, ok := parseIp(val)
+				if !ok {
+					// Obfuscated identifiers ("unknown", "_hidden") break the chain.
+					chain = nil
+					continue
+				}
+				chain = append(chain, addr)
+			}
+		}
+	}
+	return chain
+}
+
+func addrStrings(addrs []netip.Addr) []string {
+	out := make([]string, len(addrs))
+	for i, addr := range addrs {
+		out[i] = addr.String()
+	}
+	return out
+}
+
+// clientIpMiddleware resolves the client IP once per request and stores it on
+// the gin context for handlers and the access log.
+func clientIpMiddleware(c *gin.Context) {
+	resolution := ClientIp.Resolve(c.Request)
+	c.Set("client-ip", resolution)
+	c.Next()
+}
+
+// resolvedClientIp returns the resolution stored by clientIpMiddleware.
+func resolvedClientIp(c *gin.Context) ClientIpResolution {
+	if value, exists := c.Get("client-ip"); exists {
+		if resolution, ok := value.(ClientIpResolution); ok {
+			return resolution
+		}
+	}
+	return ClientIp.Resolve(c.Request)
+}
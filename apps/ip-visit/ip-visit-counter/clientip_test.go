@@ -0,0 +1,262 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestParseIp(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // "" when invalid
+	}{
+		{"203.0.113.7", "203.0.113.7"},
+		{"203.0.113.7:4711", "203.0.113.7"},
+		{" 203.0.113.7 ", "203.0.113.7"},
+		{`"203.0.113.7"`, "203.0.113.7"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{`"[2001:db8::1]:4711"`, "2001:db8::1"},
+		{"::ffff:203.0.113.7", "203.0.113.7"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"unknown", ""},
+		{"_hidden", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		addr, ok := parseIp(tt.value)
+		got := ""
+		if ok {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseIp(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSetupClientIp(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies string
+		headers        string
+		wantTrusted    []string
+		wantUntrusted  []string
+		wantErr        bool
+	}{
+		{name: "empty", wantUntrusted: []string{"10.0.0.1"}},
+		{
+			name:           "cidrs and addresses",
+			trustedProxies: "10.0.0.0/8, 192.0.2.1, ::ffff:198.51.100.0/120, 2001:db8::/32",
+			headers:        "X-Forwarded-For,forwarded",
+			wantTrusted:    []string{"10.1.2.3", "192.0.2.1", "198.51.100.5", "::ffff:198.51.100.5", "2001:db8::1"},
+			wantUntrusted:  []string{"192.0.2.2", "198.51.101.5", "2001:db9::1"},
+		},
+		{name: "bad cidr", trustedProxies: "10.0.0.0/33", wantErr: true},
+		{name: "mapped prefix wider than ipv4", trustedProxies: "::ffff:0:0/95", wantErr: true},
+		{name: "bad address", trustedProxies: "proxy.local", wantErr: true},
+		{name: "unsupported header", headers: "cf-connecting-ip", wantErr: true},
+	}
+	saved := ClientIp
+	t.Cleanup(func() { ClientIp = saved })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := SetupClientIp(tt.trustedProxies, tt.headers, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetupClientIp() error = %v, want error %v", err, tt.wantErr)
+			}
+			for _, ip := range tt.wantTrusted {
+				if addr, _ := parseIp(ip); !ClientIp.trusted(addr) {
+					t.Errorf("%s not trusted", ip)
+				}
+			}
+			for _, ip := range tt.wantUntrusted {
+				if addr, _ := parseIp(ip); ClientIp.trusted(addr) {
+					t.Errorf("%s trusted", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    string
+		headers    string
+		depth      int
+		remoteAddr string
+		header     http.Header
+		wantIp     string
+		wantSource string
+		wantChain  []string
+	}{
+		{
+			name:       "no trusted proxies ignores headers",
+			headers:    "x-forwarded-for",
+			remoteAddr: "203.0.113.7:4711",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			wantIp:     "203.0.113.7",
+			wantSource: ClientIpSourceRemoteAddr,
+			wantChain:  []string{"203.0.113.7"},
+		},
+		{
+			name:       "untrusted peer ignores headers",
+			trusted:    "10.0.0.0/8",
+			headers:    "x-forwarded-for",
+			remoteAddr: "203.0.113.7:4711",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			wantIp:     "203.0.113.7",
+			wantSource: ClientIpSourceRemoteAddr,
+			wantChain:  []string{"203.0.113.7"},
+		},
+		{
+			name:       "x-forwarded-for skips trusted hops",
+			trusted:    "10.0.0.0/8",
+			headers:    "x-forwarded-for",
+			remoteAddr: "10.0.0.2:4711",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.9, 203.0.113.7, 10.0.0.1"}},
+			wantIp:     "203.0.113.7",
+			wantSource: ClientIpSourceXForwardedFor,
+			wantChain:  []string{"198.51.100.9", "203.0.113.7", "10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:       "x-forwarded-for across header lines",
+			trusted:    "10.0.0.0/8",
+			headers:    "x-forwarded-for",
+			remoteAddr: "10.0.0.2:4711",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.7", "10.0.0.1"}},
+			wantIp:     "203.0.113.7",
+			wantSource: ClientIpSourceXForwardedFor,
+			wantChain:  []string{"203.0.113.7", "10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:       "all hops trusted picks the leftmost",
+			trusted:    "10.0.0.0/8",
+			headers:    "x-forwarded-for",
+			remoteAddr: "10.0.0.2:4711",
+			header:     http.Header{"X-Forwarded-For": {"10.0.0.9, 10.0.0.1"}},
+			wantIp:     "10.0.0.9",
+			wantSource: ClientIpSourceXForwardedFor,
+			wantChain:  []string{"10.0.0.9", "10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:       "malformed hop drops everything left of it",
+			trusted:    "10.0.0.0/8",
+			headers:    "x-forwarded-for",
+			remoteAddr: "10.0.0.2:4711",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.9, garbage, 203.0.113.7"}},
+			wantIp:     "203.0.113.7",
+			wantSource: ClientIpSourceXForwardedFor,
+			wantChain:  []string{"203.0.113.7", "10.0.0.2"},
+		},
+		{
+			name:       "depth counts from the right",
+			trusted:    "10.0.0.0/8",
+			headers:    "x-forwarded-for",
+			depth:      2,
+			remoteAddr: "10.0.0.2:4711",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.9, 203.0.113.7, 10.0.0.1"}},
+			wantIp:     "203.0.113.7",
+			wantSource: ClientIpSourceXForwardedFor,
+			wantChain:  []string{"198.51.100.9", "203.0.113.7", "10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:       "depth past the chain picks the leftmost",
+			trusted:    "10.0.0.0/8",
+			headers:    "x-forwarded-for",
+			depth:      5,
+			remoteAddr: "10.0.0.2:4711",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.7"}},
+			wantIp:     "203.0.113.7",
+			wantSource: ClientIpSourceXForwardedFor,
+			wantChain:  []string{"203.0.113.7", "10.0.0.2"},
+		},
+		{
+			name:       "forwarded for= parameters",
+			trusted:    "10.0.0.0/8",
+			headers:    "forwarded",
+			remoteAddr: "10.0.0.2:4711",
+			header:     http.Header{"Forwarded": {`for=203.0.113.7;proto=https, For="[2001:db8::1]:4711"`}},
+			wantIp:     "2001:db8::1",
+			wantSource: ClientIpSourceForwarded,
+			wantChain:  []string{"203.0.113.7", "2001:db8::1", "10.0.0.2"},
+		},
+		{
+			name:       "forwarded obfuscated identifier breaks the chain",
+			trusted:    "10.0.0.0/8",
+			headers:    "forwarded",
+			remoteAddr: "10.0.0.2:4711",
+			header:     http.Header{"Forwarded": {"for=198.51.100.9, for=_hidden, for=203.0.113.7"}},
+			wantIp:     "203.0.113.7",
+			wantSource: ClientIpSourceForwarded,
+			wantChain:  []string{"203.0.113.7", "10.0.0.2"},
+		},
+		{
+			name:       "x-real-ip",
+			trusted:    "10.0.0.0/8",
+			headers:    "x-real-ip",
+			remoteAddr: "10.0.0.2:4711",
+			header:     http.Header{"X-Real-Ip": {"203.0.113.7"}},
+			wantIp:     "203.0.113.7",
+			wantSource: ClientIpSourceXRealIp,
+			wantChain:  []string{"203.0.113.7", "10.0.0.2"},
+		},
+		{
+			name:       "falls through to the next header",
+			trusted:    "10.0.0.0/8",
+			headers:    "x-real-ip,x-forwarded-for",
+			remoteAddr: "10.0.0.2:4711",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.7"}},
+			wantIp:     "203.0.113.7",
+			wantSource: ClientIpSourceXForwardedFor,
+			wantChain:  []string{"203.0.113.7", "10.0.0.2"},
+		},
+		{
+			name:       "no usable header keeps the peer",
+			trusted:    "10.0.0.0/8",
+			headers:    "x-real-ip,x-forwarded-for",
+			remoteAddr: "10.0.0.2:4711",
+			wantIp:     "10.0.0.2",
+			wantSource: ClientIpSourceRemoteAddr,
+			wantChain:  []string{"10.0.0.2"},
+		},
+		{
+			name:       "ipv4-mapped peer matches an ipv4 proxy",
+			trusted:    "10.0.0.0/8",
+			headers:    "x-forwarded-for",
+			remoteAddr: "[::ffff:10.0.0.2]:4711",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.7"}},
+			wantIp:     "203.0.113.7",
+			wantSource: ClientIpSourceXForwardedFor,
+			wantChain:  []string{"203.0.113.7", "10.0.0.2"},
+		},
+		{
+			name:       "unparsable peer",
+			remoteAddr: "@",
+			wantIp:     "@",
+			wantSource: ClientIpSourceRemoteAddr,
+			wantChain:  []string{"@"},
+		},
+	}
+	saved := ClientIp
+	t.Cleanup(func() { ClientIp = saved })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetupClientIp(tt.trusted, tt.headers, tt.depth); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/count", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			got := ClientIp.Resolve(req)
+			if got.Ip != tt.wantIp || got.Source != tt.wantSource || !slices.Equal(got.Chain, tt.wantChain) {
+				t.Errorf("Resolve() = %+v, want {Ip:%s Source:%s Chain:%v}", got, tt.wantIp, tt.wantSource, tt.wantChain)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/segmentio/kafka-go"
+)
+
+// Event formats for published visits, selected with EVENTFORMAT.
+const (
+	EventFormatCloudEvents = "cloudevents"
+	EventFormatLegacy      = "legacy"
+)
+
+// CloudEvents attributes for visit events. See https://cloudevents.io.
+const (
+	CloudEventsSpecVersion = "1.0"
+	VisitEventType         = "co.metalbear.playground.visit"
+	// CloudEventsContentType is the structured-mode media type.
+	CloudEventsContentType = "application/cloudevents+json"
+)
+
+var EventFormat = EventFormatCloudEvents
+var EventSource = "/ip-visit/ip-visit-counter"
+
+// CloudEvent
+// Structured-mode CloudEvents envelope. Tenant and Baggage are extension
+// attributes carrying x-pg-tenant and the W3C baggage header.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Id              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Tenant          string          `json:"tenant,omitempty"`
+	Baggage         string          `json:"baggage,omitempty"`
+	Data            json.RawMessage `json:"data"`
+}
+
+func (v *Visit) cloudEvent(data []byte) CloudEvent {
+	return CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		Id:              v.EventId,
+		Source:          EventSource,
+		Type:            VisitEventType,
+		Time:            v.Timestamp,
+		DataContentType: "application/json",
+		Tenant:          v.Tenant,
+		Baggage:         v.Baggage,
+		Data:            data,
+	}
+}
+
+// KafkaMessage
+// Build the Kafka record for a visit. CloudEvents use binary mode: the value
+// stays the plain IpMessage and the attributes travel as ce_ headers.
+func (v *Visit) KafkaMessage() kafka.Message {
+	data, _ := json.Marshal(v.Message())
+	headers := []kafka.Header{}
+	// x-pg-tenant stays in both formats; mirrord queue splitting filters on it.
+	if v.Tenant != "" {
+		headers = append(headers, kafka.Header{Key: "x-pg-tenant", Value: []byte(v.Tenant)})
+	}
+	if EventFormat == EventFormatCloudEvents {
+		event := v.cloudEvent(data)
+		headers = append(headers,
+			kafka.Header{Key: "ce_specversion", Value: []byte(event.SpecVersion)},
+			kafka.Header{Key: "ce_id", Value: []byte(event.Id)},
+			kafka.Header{Key: "ce_source", Value: []byte(event.Source)},
+			kafka.Header{Key: "ce_type", Value: []byte(event.Type)},
+			kafka.Header{Key: "ce_time", Value: []byte(event.Time.Format(time.RFC3339Nano))},
+			kafka.Header{Key: "content-type", Value: []byte(event.DataContentType)},
+		)
+		if event.Tenant != "" {
+			headers = append(headers, kafka.Header{Key: "ce_tenant", Value: []byte(event.Tenant)})
+		}
+		if event.Baggage != "" {
+			headers = append(headers, kafka.Header{Key: "ce_baggage", Value: []byte(event.Baggage)})
+		}
+	}
+	return kafka.Message{Value: data, Headers: headers}
+}
+
+// SqsMessage
+// Build the SQS body and attributes for a visit. CloudEvents use structured
+// mode: the whole envelope is the body, with the IpMessage under data.
+func (v *Visit) SqsMessage() (string, map[string]types.MessageAttributeValue) {
+	data, _ := json.Marshal(v.Message())
+	attributes := map[string]types.MessageAttributeValue{}
+	// x-pg-tenant stays in both formats; mirrord queue splitting filters on it.
+	if v.Tenant != "" {
+		attributes["x-pg-tenant"] = stringAttribute(v.Tenant)
+	}
+	if EventFormat != EventFormatCloudEvents {
+		return string(data), attributes
+	}
+	body, _ := json.Marshal(v.cloudEvent(data))
+	attributes["content-type"] = stringAttribute(CloudEventsContentType)
+	return string(body), attributes
+}
+
+func stringAttribute(value string) types.MessageAttributeValue {
+	return types.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(value),
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// VisitEvent
+// One visit as pushed to /visits/stream subscribers. Ip is the anonymized form.
+type VisitEvent struct {
+	Ip     string  `json:"ip"`
+	Tenant string  `json:"tenant"`
+	Count  int64   `json:"count"`
+	Info   *IpInfo `json:"info,omitempty"`
+	// Decision is the tag policy action, e.g. "flag"; empty for ordinary visits.
+	Decision string `json:"decision,omitempty"`
+	TS       int64  `json:"ts"` // unix millis
+}
+
+// feedBuffer is how many events a slow subscriber may lag behind before
+// further events are dropped for it.
+const feedBuffer = 64
+
+const feedHeartbeat = 15 * time.Second
+
+// VisitFeed
+// Fans visit events out to SSE subscribers. With a Redis client, events go
+// through a pub/sub channel so every counter replica sees every visit, including
+// its own; without one they are delivered in-process only.
+type VisitFeed struct {
+	redis   redis.UniversalClient
+	channel string
+
+	mu          sync.Mutex
+	subscribers map[chan VisitEvent]struct{}
+	// closed ends every open stream on shutdown.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var Feed *VisitFeed
+
+// SetupFeed
+// Create the visit feed and, when Redis is available, start relaying pub/sub
+func SetupFeed(client redis.UniversalClient) {
+	Feed = &VisitFeed{
+		redis:       client,
+		channel:     RedisKey + "visits",
+		subscribers: map[chan VisitEvent]struct{}{},
+		closed:      make(chan struct{}),
+	}
+	if client != nil {
+		go Feed.relay()
+	}
+}
+
+// Publish
+// Send a visit to every subscriber on every replica
+func (f *VisitFeed) Publish(ctx context.Context, event VisitEvent) {
+	if f.redis == nil {
+		f.broadcast(event)
+		return
+	}
+	payload, _ := json.Marshal(event)
+	if err := f.redis.Publish(ctx, f.channel, payload).Err(); err != nil {
+		log.Printf("failed to publish visit event: %v", err)
+	}
+}
+
+func (f *VisitFeed) relay() {
+	pubsub := f.redis.Subscribe(ctx, f.channel)
+	defer pubsub.Close()
+	for message := range pubsub.Channel() {
+		var event VisitEvent
+		if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+			log.Printf("bad visit event: %v", err)
+			continue
+		}
+		f.broadcast(event)
+	}
+}
+
+func (f *VisitFeed) broadcast(event VisitEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Never let one stalled browser hold up the handler or other subscribers.
+		}
+	}
+}
+
+// Close
+// End every open /visits/stream, so the server can shut down without waiting for them
+func (f *VisitFeed) Close() {
+	f.closeOnce.Do(func() { close(f.closed) })
+}
+
+// Subscribe
+// Register a subscriber; the returned func unregisters it
+func (f *VisitFeed) Subscribe() (<-chan VisitEvent, func()) {
+	ch := make(chan VisitEvent, feedBuffer)
+	f.mu.Lock()
+	f.subscribers[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch, func() {
+		f.mu.Lock()
+		delete(f.subscribers, ch)
+		f.mu.Unlock()
+	}
+}
+
+// streamVisits serves GET /visits/stream as Server-Sent Events. An optional
+// ?tenant= restricts the stream to one tenant's visits.
+func streamVisits(c *gin.Context) {
+	tenant, filtered := c.GetQuery("tenant")
+	events, unsubscribe := Feed.Subscribe()
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	// Send headers right away so the browser's EventSource opens before the first visit.
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-Feed.closed:
+			// Browsers' EventSource reconnects, to another replica.
+			return false
+		case <-heartbeat.C:
+			c.SSEvent("heartbeat", gin.H{"ts": time.Now().UnixMilli()})
+			return true
+		case event := <-events:
+			if !filtered || event.Tenant == tenant {
+				c.SSEvent("visit", event)
+			}
+			return true
+		}
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// Visit history: with the Redis store, every recorded visit is also appended
+// to a capped Redis stream. The rollup reads that stream from a checkpoint and
+// adds it to daily aggregates in Postgres, which /visits/history serves.
+
+// visitLogMaxLen caps the visit stream. Visits older than this are lost if the
+// rollup falls that far behind.
+const visitLogMaxLen = 100000
+
+const rollupBatch = 1000
+
+var HistoryDB *pgxpool.Pool
+
+func visitLogKey() string {
+	return RedisKey + "events"
+}
+
+// LogVisit
+// Append a recorded visit to the stream the rollup reads
+func LogVisit(ctx context.Context, visit *Visit) {
+	if RedisClient == nil {
+		return
+	}
+	err := RedisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: visitLogKey(),
+		MaxLen: visitLogMaxLen,
+		Approx: true,
+		Values: map[string]any{
+			"visitor": visit.VisitorIp,
+			"tenant":  visit.Tenant,
+			"path":    visit.Path,
+			"ts":      visit.Timestamp.UnixMilli(),
+		},
+	}).Err()
+	if err != nil {
+		log.Printf("failed to log visit for rollup: %v", err)
+	}
+}
+
+// SetupHistory
+// Connect to Postgres and ensure the aggregate and checkpoint tables exist
+func SetupHistory(url string) error {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return err
+	}
+	if _, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS ip_visit_daily (
+		day date NOT NULL,
+		visitor text NOT NULL,
+		tenant text NOT NULL DEFAULT '',
+		path text NOT NULL DEFAULT '',
+		count bigint NOT NULL,
+		PRIMARY KEY (day, visitor, tenant, path)
+	)`); err != nil {
+		pool.Close()
+		return err
+	}
+	if _, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS ip_visit_rollup_checkpoint (
+		id int PRIMARY KEY,
+		stream_id text NOT NULL,
+		updated_at timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		pool.Close()
+		return err
+	}
+	HistoryDB = pool
+	return nil
+}
+
+// RunRollup
+// Roll up the visit stream every interval, until ctx is done. An interval of 0
+// runs once.
+func RunRollup(ctx context.Context, interval time.Duration) error {
+	for {
+		n, err := RollupOnce(ctx)
+		if ctx.Err() != nil {
+			// Stopped mid-batch; the batch rolled back and is redone next time.
+			return nil
+		}
+		if err != nil {
+			if interval == 0 {
+				return err
+			}
+			log.Printf("rollup failed: %v", err)
+		} else {
+			log.Printf("rollup: aggregated %d visit(s)", n)
+		}
+		if interval == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// RollupOnce
+// Aggregate every visit after the checkpoint into ip_visit_daily. Each batch
+// and its checkpoint commit together, and the checkpoint row is locked, so
+// concurrent rollups never count a visit twice.
+func RollupOnce(ctx context.Context) (int, error) {
+	if _, err := HistoryDB.Exec(ctx, `
+		INSERT INTO ip_visit_rollup_checkpoint (id, stream_id) VALUES (1, '0-0')
+		ON CONFLICT (id) DO NOTHING`); err != nil {
+		return 0, err
+	}
+	total := 0
+	for {
+		n, err := rollupBatchOnce(ctx)
+		total += n
+		if err != nil || n == 0 {
+			return total, err
+		}
+	}
+}
+
+type dailyKey struct {
+	day     string
+	visitor string
+	tenant  string
+	path    string
+}
+
+func rollupBatchOnce(ctx context.Context) (int, error) {
+	tx, err := HistoryDB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var checkpoint string
+	if err := tx.QueryRow(ctx, `SELECT stream_id FROM ip_visit_rollup_checkpoint WHERE id = 1 FOR UPDATE`).Scan(&checkpoint); err != nil {
+		return 0, err
+	}
+
+	entries, err := RedisClient.XRangeN(ctx, visitLogKey(), "("+checkpoint, "+", rollupBatch).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	counts := map[dailyKey]int64{}
+	for _, entry := range entries {
+		ts, _ := strconv.ParseInt(fmt.Sprint(entry.Values["ts"]), 10, 64)
+		key := dailyKey{
+			day:     time.UnixMilli(ts).UTC().Format(time.DateOnly),
+			visitor: fmt.Sprint(entry.Values["visitor"]),
+			tenant:  fmt.Sprint(entry.Values["tenant"]),
+			path:    fmt.Sprint(entry.Values["path"]),
+		}
+		counts[key]++
+	}
+
+	batch := &pgx.Batch{}
+	for key, count := range counts {
+		batch.Queue(`
+			INSERT INTO ip_visit_daily (day, visitor, tenant, path, count) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (day, visitor, tenant, path) DO UPDATE SET count = ip_visit_daily.count + EXCLUDED.count`,
+			key.day, key.visitor, key.tenant, key.path, count)
+	}
+	batch.Queue(`UPDATE ip_visit_rollup_checkpoint SET stream_id = $1, updated_at = now() WHERE id = 1`,
+		entries[len(entries)-1].ID)
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return 0, err
+	}
+	return len(entries), tx.Commit(ctx)
+}
+
+// HistoryRow
+// Visits on one day for one group (tenant, path or visitor)
+type HistoryRow struct {
+	Day   string `json:"day"`
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+var historyColumns = map[string]string{"tenant": "tenant", "path": "path", "ip": "visitor"}
+
+// getHistory serves GET /visits/history?days=7&by=tenant|path|ip&tenant=...
+func getHistory(c *gin.Context) {
+	if HistoryDB == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Visit history is not enabled"})
+		return
+	}
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days must be a positive number"})
+		return
+	}
+	by := c.DefaultQuery("by", "tenant")
+	column, ok := historyColumns[by]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "by must be one of tenant, path, ip"})
+		return
+	}
+	tenant, filtered := c.GetQuery("tenant")
+
+	rows, err := HistoryDB.Query(c, `
+		SELECT to_char(day, 'YYYY-MM-DD'), `+column+`, sum(count)::bigint
+		FROM ip_visit_daily
+		WHERE day > current_date - $1::int AND (NOT $2 OR tenant = $3)
+		GROUP BY day, `+column+`
+		ORDER BY day, `+column, days, filtered, tenant)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Internal server error"})
+		return
+	}
+	history, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (HistoryRow, error) {
+		var r HistoryRow
+		err := row.Scan(&r.Day, &r.Key, &r.Count)
+		return r, err
+	})
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(500, gin.H{"error": "Internal server error"})
+		return
+	}
+	c.JSON(200, gin.H{"by": by, "days": days, "history": history})
+}
+
+// runRollupMode runs the rollup on its own, e.g. from a CronJob, using the
+// same Redis settings as the counter.
+func runRollupMode(config Config) {
+	if config.HistoryDatabaseUrl == "" {
+		log.Fatal("rollup needs HISTORYDATABASEURL or DATABASEURL")
+	}
+	if err := SetupRedis(config.Redis); err != nil {
+		log.Fatalf("unable to connect to redis, %v", err)
+	}
+	if err := SetupHistory(config.HistoryDatabaseUrl); err != nil {
+		log.Fatal(err)
+	}
+	shutdown, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	err := RunRollup(shutdown, config.RollupInterval)
+	HistoryDB.Close()
+	RedisClient.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -3,21 +3,24 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
+	"github.com/metalbear-co/playground/internal/health"
 	"github.com/redis/go-redis/v9"
 	"github.com/segmentio/kafka-go"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
-	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/gin-gonic/gin"
 	pb "github.com/metalbear-co/playground/protogen"
 	"github.com/spf13/viper"
@@ -26,33 +29,19 @@ import (
 )
 
 var ctx = context.Background()
-var RedisClient *redis.Client
+var RedisClient redis.UniversalClient
 var KafkaWriter *kafka.Writer
 var RedisKey = "ip-visit-counter-"
-var ResponseString = ""
 var IpInfoAddress = ""
 var IpInfoGrpcAddress = ""
 var SqsQueueUrl = ""
 var sqsClient *sqs.Client
+var DebugResponse = false
+var LegacyCount = false
+var IdempotencyWindow = 24 * time.Hour
 
 const RedisKeyTtl = 120 * time.Second
 
-// SetupRedis
-// Initialize the Redis instance
-func SetupRedis(address string) error {
-	RedisClient = redis.NewClient(&redis.Options{
-		Addr:     address,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-	err := RedisClient.Ping(ctx).Err()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 // SetupKafka
 // Initialize the Kafka Writer
 func SetupKafka(address, topic string) {
@@ -87,72 +76,199 @@ func SetupSqs(queue_name string) error {
 // Struct that holds local service port, remote redis host and port
 type Config struct {
 	Port         int16
-	RedisAddress string
+	Store        string // redis (default), postgres or memory
+	Redis        RedisConfig
+	DatabaseUrl  string
 	ResponseFile string
-	KafkaAddress string
-	KafkaTopic   string
-	SqsQueueName string
+	// TenantResponseFile is an optional path containing "{tenant}" that
+	// overrides ResponseFile for that tenant, e.g. /app/tenants/{tenant}.txt.
+	TenantResponseFile string
+	KafkaAddress       string
+	KafkaTopic         string
+	SqsQueueName       string
+	PrivacyMode        string
+	PrivacyKey         string
+	// TrustedProxies is a comma-separated list of CIDRs (or single IPs) whose
+	// proxy headers are honored; ClientIpHeaders lists which headers, in order.
+	TrustedProxies  string
+	ClientIpHeaders string
+	ForwardedDepth  int
+	DebugResponse   bool
+	// LegacyCount makes GET /count record a visit, as it did before POST /visits.
+	LegacyCount       bool
+	IdempotencyWindow time.Duration
+	// TagPolicy maps ip-info tags to actions ("blocked=reject,bot=skip");
+	// TagPolicyFile is a JSON file with per-tenant overrides.
+	TagPolicy     string
+	TagPolicyFile string
+	// EventFormat is cloudevents (default) or legacy, the bare IpMessage.
+	EventFormat string
+	EventSource string
+	// HistoryDatabaseUrl enables /visits/history and the rollup; with the
+	// Redis store it defaults to DatabaseUrl. Rollup runs the rollup instead
+	// of serving, every RollupInterval, or once when it is 0.
+	HistoryDatabaseUrl string
+	Rollup             bool
+	RollupInterval     time.Duration
+	// ShutdownTimeout bounds how long in-flight requests get on SIGTERM.
+	ShutdownTimeout time.Duration
 }
 
+// IpMessageVersion is the current IpMessage schema. Version 1 carried only
+// ip; every later field is additive, so consumers that read ip keep working.
+const IpMessageVersion = 2
+
+// IpMessage
+// Visit event published to Kafka and SQS
 type IpMessage struct {
-	Ip string `json:"ip"`
+	Version   int       `json:"version"`
+	EventId   string    `json:"event_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Ip        string    `json:"ip"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	// Client is the User-Agent class: browser, bot, cli or unknown.
+	Client string `json:"client"`
+	// Info and Info2 are the ip-info and ip-info-grpc enrichments.
+	Info  *IpInfo `json:"info,omitempty"`
+	Info2 *IpInfo `json:"info2,omitempty"`
+	// Decision and Tags record the tag policy outcome for flagged visits.
+	Decision string   `json:"decision,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
 }
 
 type IpInfo struct {
-	Ip   string `json:"ip"`
-	Info string `json:"name"`
+	Ip   string   `json:"ip"`
+	Info string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
 }
 
 func loadConfig() Config {
 	viper.BindEnv("port")
+	viper.BindEnv("store")
+	viper.BindEnv("databaseurl")
 	viper.BindEnv("redisaddress")
+	viper.BindEnv("redisurl")
+	viper.BindEnv("redismode")
+	viper.BindEnv("redismastername")
+	viper.BindEnv("redisusername")
+	viper.BindEnv("redispassword")
+	viper.BindEnv("redissentinelusername")
+	viper.BindEnv("redissentinelpassword")
+	viper.BindEnv("redisdb")
+	viper.BindEnv("redistls")
+	viper.BindEnv("redistlscafile")
+	viper.BindEnv("redistlsskipverify")
+	viper.BindEnv("redisconnecttimeout")
+	viper.SetDefault("redisconnecttimeout", "60s")
 	viper.BindEnv("responsefile")
+	viper.BindEnv("tenantresponsefile")
 	viper.BindEnv("kafkaaddress")
 	viper.BindEnv("kafkatopic")
 	viper.BindEnv("ipinfoaddress")
 	viper.BindEnv("sqsqueuename")
 	viper.BindEnv("ipinfogrpcaddress")
+	viper.BindEnv("privacymode")
+	viper.BindEnv("privacykey")
+	viper.BindEnv("trustedproxies")
+	viper.BindEnv("clientipheaders")
+	viper.BindEnv("forwardeddepth")
+	viper.BindEnv("debugresponse")
+	viper.BindEnv("legacycount")
+	viper.BindEnv("idempotencywindow")
+	viper.SetDefault("idempotencywindow", "24h")
+	viper.BindEnv("tagpolicy")
+	viper.BindEnv("tagpolicyfile")
+	viper.SetDefault("tagpolicy", "blocked=reject,bot=skip,internal=flag")
+	viper.BindEnv("eventformat")
+	viper.BindEnv("eventsource")
+	viper.SetDefault("eventformat", EventFormatCloudEvents)
+	viper.SetDefault("eventsource", EventSource)
+	viper.SetDefault("clientipheaders", "x-forwarded-for,x-real-ip")
+	viper.BindEnv("historydatabaseurl")
+	viper.BindEnv("rollup")
+	viper.BindEnv("rollupinterval")
+	viper.BindEnv("shutdowntimeout")
+	viper.SetDefault("shutdowntimeout", "20s")
 
 	config := Config{}
 	config.Port = int16(viper.GetInt("port"))
-	config.RedisAddress = viper.GetString("redisaddress")
+	config.Store = viper.GetString("store")
+	config.DatabaseUrl = viper.GetString("databaseurl")
+	config.Redis = RedisConfig{
+		Address:          viper.GetString("redisaddress"),
+		Url:              viper.GetString("redisurl"),
+		Mode:             viper.GetString("redismode"),
+		MasterName:       viper.GetString("redismastername"),
+		Username:         viper.GetString("redisusername"),
+		Password:         viper.GetString("redispassword"),
+		SentinelUsername: viper.GetString("redissentinelusername"),
+		SentinelPassword: viper.GetString("redissentinelpassword"),
+		DB:               viper.GetInt("redisdb"),
+		Tls:              viper.GetBool("redistls"),
+		TlsCaFile:        viper.GetString("redistlscafile"),
+		TlsSkipVerify:    viper.GetBool("redistlsskipverify"),
+		ConnectTimeout:   viper.GetDuration("redisconnecttimeout"),
+	}
 	config.ResponseFile = viper.GetString("responsefile")
+	config.TenantResponseFile = viper.GetString("tenantresponsefile")
 	config.KafkaAddress = viper.GetString("kafkaaddress")
 	config.KafkaTopic = viper.GetString("kafkatopic")
 	IpInfoAddress = viper.GetString("ipinfoaddress")
 	IpInfoGrpcAddress = viper.GetString("ipinfogrpcaddress")
 	config.SqsQueueName = viper.GetString("sqsqueuename")
+	config.PrivacyMode = viper.GetString("privacymode")
+	config.PrivacyKey = viper.GetString("privacykey")
+	config.TrustedProxies = viper.GetString("trustedproxies")
+	config.ClientIpHeaders = viper.GetString("clientipheaders")
+	config.ForwardedDepth = viper.GetInt("forwardeddepth")
+	config.DebugResponse = viper.GetBool("debugresponse")
+	config.LegacyCount = viper.GetBool("legacycount")
+	config.IdempotencyWindow = viper.GetDuration("idempotencywindow")
+	config.TagPolicy = viper.GetString("tagpolicy")
+	config.TagPolicyFile = viper.GetString("tagpolicyfile")
+	config.EventFormat = viper.GetString("eventformat")
+	config.EventSource = viper.GetString("eventsource")
+	config.HistoryDatabaseUrl = viper.GetString("historydatabaseurl")
+	// Only the Redis store logs visits for the rollup, so other stores don't
+	// get an always-empty history just because DATABASEURL is set.
+	if config.HistoryDatabaseUrl == "" && (config.Store == "" || config.Store == StoreRedis) {
+		config.HistoryDatabaseUrl = config.DatabaseUrl
+	}
+	config.Rollup = viper.GetBool("rollup")
+	config.RollupInterval = viper.GetDuration("rollupinterval")
+	config.ShutdownTimeout = viper.GetDuration("shutdowntimeout")
 
 	return config
 }
 
-func SendSqsMessage(c *gin.Context, message []byte) {
-	var messageAttributes map[string]types.MessageAttributeValue
-
-	tenant, exists := c.Get("x-pg-tenant")
-	if exists {
-		if tenantStr, ok := tenant.(string); ok {
-			messageAttributes = map[string]types.MessageAttributeValue{
-				"x-pg-tenant": {
-					DataType:    aws.String("String"),
-					StringValue: aws.String(tenantStr),
-				},
-			}
-		}
-	}
+func SendSqsMessage(c *gin.Context, visit *Visit) error {
+	body, messageAttributes := visit.SqsMessage()
 
 	sendMessageInput := &sqs.SendMessageInput{
 		QueueUrl:          aws.String(SqsQueueUrl),
-		MessageBody:       aws.String(string(message)),
+		MessageBody:       aws.String(body),
 		MessageAttributes: messageAttributes,
 	}
+	// FIFO queues keep each visitor's events in order, and drop resends of the same event.
+	if strings.HasSuffix(SqsQueueUrl, ".fifo") {
+		sendMessageInput.MessageGroupId = aws.String(visit.VisitorIp)
+		sendMessageInput.MessageDeduplicationId = aws.String(visit.EventId)
+	}
 
 	result, err := sqsClient.SendMessage(c, sendMessageInput)
 	if err != nil {
-		log.Fatalf("failed to send message, %v", err)
+		return fmt.Errorf("failed to send message, %w", err)
 	}
 	// Print the message ID of the sent message
 	fmt.Printf("Message sent, ID: %s\n", *result.MessageId)
+	return nil
+}
+
+func SendKafkaMessage(c *gin.Context, visit *Visit) error {
+	return KafkaWriter.WriteMessages(c, visit.KafkaMessage())
 }
 
 func getIpInfoGrpc(ip string, c *gin.Context) (*IpInfo, error) {
@@ -178,112 +294,112 @@ func getIpInfoGrpc(ip string, c *gin.Context) (*IpInfo, error) {
 	return &IpInfo{
 		Ip:   res.Ip,
 		Info: res.Info,
+		Tags: res.Tags,
 	}, nil
 
 }
 
-func getCount(c *gin.Context) {
-	ip := c.ClientIP()
-	key := RedisKey + ip
-	// header propagation
-	tenant := c.GetHeader("x-pg-tenant")
-	if tenant != "" {
-		c.Set("x-pg-tenant", tenant)
-	}
-
-	count, err := RedisClient.Incr(c, key).Result()
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Internal server error"})
-		return
-	}
-
-	RedisClient.Expire(c, key, RedisKeyTtl)
-	message, _ := json.Marshal(IpMessage{Ip: ip})
-
-	if sqsClient != nil {
-		SendSqsMessage(c, message)
-	}
-
-	headers := []kafka.Header{}
-	tenantInterface, exists := c.Get("x-pg-tenant")
-	if exists {
-		if tenantStr, ok := tenantInterface.(string); ok {
-			headers = append(headers, kafka.Header{Key: "x-pg-tenant", Value: []byte(tenantStr)})
-		}
-	}
-
-	err = KafkaWriter.WriteMessages(c, kafka.Message{
-		Value:   []byte(message),
-		Headers: headers,
-	})
-
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Internal server error"})
-		return
-	}
-
-	ipInfo2, err := getIpInfoGrpc(ip, c)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Internal server error"})
-		return
-	}
-
+func getIpInfoHttp(ip string, c *gin.Context) (*IpInfo, error) {
 	ip_req_url, err := url.Parse(IpInfoAddress)
-
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Internal server error"})
-		return
+		return nil, err
 	}
 	ip_req_url = ip_req_url.JoinPath("ip", ip)
 	req, err := http.NewRequestWithContext(c, "GET", ip_req_url.String(), nil)
-
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Internal server error"})
-		return
+		return nil, err
 	}
 
-	req.Header.Set("x-pg-tenant", tenant)
+	req.Header.Set("x-pg-tenant", c.GetString("x-pg-tenant"))
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Internal server error"})
-		return
+		return nil, err
 	}
 	defer res.Body.Close()
 
 	ipInfo := &IpInfo{}
-
 	err = json.NewDecoder(res.Body).Decode(&ipInfo)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Internal server error"})
-		return
+		return nil, err
 	}
+	return ipInfo, nil
+}
 
-	demoMarker := "production"
-	if tenant != "" {
-		demoMarker = tenant
+// setupHealthChecks
+// Register a readiness check for the stores the counter keeps its state in.
+// Kafka, SQS and ip-info are left out: an outage of one of them fails the
+// requests that need it, but must not take every counter pod out of service.
+func setupHealthChecks() {
+	if RedisClient != nil {
+		health.AddCheck("redis", func(ctx context.Context) error {
+			return RedisClient.Ping(ctx).Err()
+		})
+	}
+	if store, ok := Store.(*PostgresStore); ok {
+		health.AddCheck("postgres", store.pool.Ping)
+	}
+	if HistoryDB != nil {
+		health.AddCheck("history-postgres", HistoryDB.Ping)
 	}
-	c.JSON(200, gin.H{"count": count, "text": ResponseString + "hi", "info": ipInfo, "info2": ipInfo2, "demo_marker": demoMarker})
 }
 
 func main() {
 
 	config := loadConfig()
 
-	fileContent, err := os.ReadFile(config.ResponseFile)
+	if config.Rollup {
+		runRollupMode(config)
+		return
+	}
+
+	err := SetupResponses(config.ResponseFile, config.TenantResponseFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	ResponseString = string(fileContent)
+	err = SetupPrivacy(config.PrivacyMode, config.PrivacyKey)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	err = SetupRedis(config.RedisAddress)
+	err = SetupClientIp(config.TrustedProxies, config.ClientIpHeaders, config.ForwardedDepth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	DebugResponse = config.DebugResponse
+	LegacyCount = config.LegacyCount
+	IdempotencyWindow = config.IdempotencyWindow
+	if config.EventFormat != EventFormatCloudEvents && config.EventFormat != EventFormatLegacy {
+		log.Fatalf("unknown event format %q", config.EventFormat)
+	}
+	EventFormat = config.EventFormat
+	EventSource = config.EventSource
+
+	err = SetupPolicies(config.TagPolicy, config.TagPolicyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	err = SetupStore(config)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	SetupFeed(RedisClient)
+
+	if config.HistoryDatabaseUrl != "" {
+		if RedisClient == nil {
+			log.Fatal("HISTORYDATABASEURL needs STORE=redis: visits are logged for the rollup in a Redis stream")
+		}
+		err = SetupHistory(config.HistoryDatabaseUrl)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	SetupKafka(config.KafkaAddress, config.KafkaTopic)
+	if config.KafkaAddress != "" {
+		SetupKafka(config.KafkaAddress, config.KafkaTopic)
+	}
 	if config.SqsQueueName != "" {
 		err = SetupSqs(config.SqsQueueName)
 
@@ -291,11 +407,55 @@ func main() {
 			panic(err)
 		}
 	}
-
-	router := gin.Default()
-	router.Use(cors.Default())
+	setupHealthChecks()
+
+	router := gin.New()
+	// Client IP resolution is handled by ClientIp, so gin must not trust any headers itself.
+	router.SetTrustedProxies(nil)
+	router.Use(clientIpMiddleware, gin.LoggerWithFormatter(privacyLogFormatter), gin.Recovery())
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowAllOrigins = true
+	corsConfig.AddAllowHeaders("Idempotency-Key", "X-PG-Tenant", "baggage")
+	corsConfig.AddExposeHeaders("Idempotent-Replayed")
+	router.Use(cors.New(corsConfig))
 	router.GET("/health", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+	router.GET("/livez", gin.WrapF(health.Livez))
+	router.GET("/readyz", gin.WrapF(health.Readyz))
 	router.GET("/count", getCount)
+	router.POST("/visits", postVisit)
+	router.GET("/visits/stream", streamVisits)
+	router.GET("/visits/history", getHistory)
+
+	server := &http.Server{Addr: "0.0.0.0:" + fmt.Sprint(config.Port), Handler: router}
+	// Shutdown waits for every open connection, so end the SSE streams.
+	server.RegisterOnShutdown(Feed.Close)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
 	fmt.Print("loaded")
-	router.Run("0.0.0.0:" + fmt.Sprint(config.Port))
+
+	shutdown, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-shutdown.Done()
+	log.Print("shutting down")
+
+	// Finish in-flight requests, then flush and close what they write to.
+	shutdownCtx, cancel := context.WithTimeout(ctx, config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to finish in-flight requests: %v", err)
+	}
+	if KafkaWriter != nil {
+		if err := KafkaWriter.Close(); err != nil {
+			log.Printf("failed to flush kafka writer: %v", err)
+		}
+	}
+	if HistoryDB != nil {
+		HistoryDB.Close()
+	}
+	if err := Store.Close(); err != nil {
+		log.Printf("failed to close store: %v", err)
+	}
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Actions a tag policy can take on a visit. When a visitor carries several
+// tags, the strongest action wins: allow > reject > skip > flag. allow is an
+// allowlist entry and overrides every other tag. ActionClear, written as
+// "none" in a policy, takes no action; a tenant uses it to drop a tag's
+// default action.
+const (
+	ActionNone   = ""
+	ActionFlag   = "flag"
+	ActionSkip   = "skip"
+	ActionReject = "reject"
+	ActionAllow  = "allow"
+	ActionClear  = "none"
+)
+
+var actionRank = map[string]int{ActionNone: 0, ActionFlag: 1, ActionSkip: 2, ActionReject: 3, ActionAllow: 4}
+
+// TagPolicy
+// Maps ip-info tags to actions
+type TagPolicy map[string]string
+
+// TagPolicies
+// The default policy and per-tenant overrides, merged over the default
+type TagPolicies struct {
+	Default TagPolicy            `json:"default"`
+	Tenants map[string]TagPolicy `json:"tenants"`
+}
+
+// PolicyDecision
+// The action taken on a visit and the tags that caused it
+type PolicyDecision struct {
+	Action string   `json:"action"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+var Policies = TagPolicies{Default: TagPolicy{}}
+
+// SetupPolicies
+// Load the default tag policy and, optionally, a JSON file with tenant overrides
+func SetupPolicies(defaultPolicy, file string) error {
+	policy, err := parseTagPolicy(defaultPolicy)
+	if err != nil {
+		return err
+	}
+	policies := TagPolicies{Default: policy}
+
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var fromFile TagPolicies
+		if err := json.Unmarshal(content, &fromFile); err != nil {
+			return fmt.Errorf("invalid tag policy file %s: %w", file, err)
+		}
+		for tag, action := range fromFile.Default {
+			policies.Default[tag] = action
+		}
+		policies.Tenants = fromFile.Tenants
+	}
+
+	for _, policy := range append([]TagPolicy{policies.Default}, slices.Collect(maps.Values(policies.Tenants))...) {
+		for tag, action := range policy {
+			if _, ok := actionRank[action]; action != ActionClear && (!ok || action == ActionNone) {
+				return fmt.Errorf("unknown action %q for tag %q", action, tag)
+			}
+		}
+	}
+	Policies = policies
+	return nil
+}
+
+// parseTagPolicy reads the "tag=action,tag=action" form used by TAGPOLICY.
+func parseTagPolicy(value string) (TagPolicy, error) {
+	policy := TagPolicy{}
+	for _, entry := range splitList(value) {
+		tag, action, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid tag policy entry %q, expected tag=action", entry)
+		}
+		policy[strings.TrimSpace(tag)] = strings.TrimSpace(action)
+	}
+	return policy, nil
+}
+
+// actionFor returns the tenant's override of action for tag, or the default.
+func (p TagPolicies) actionFor(tenant, tag string) string {
+	action, ok := p.Tenants[tenant][tag]
+	if !ok {
+		action = p.Default[tag]
+	}
+	if action == ActionClear {
+		return ActionNone
+	}
+	return action
+}
+
+// Decide
+// Pick the action for a visitor's tags under the tenant's policy
+func (p TagPolicies) Decide(tenant string, tags []string) PolicyDecision {
+	decision := PolicyDecision{Action: ActionNone}
+	for _, tag := range tags {
+		action := p.actionFor(tenant, tag)
+		if action == ActionNone {
+			continue
+		}
+		switch {
+		case actionRank[action] > actionRank[decision.Action]:
+			decision = PolicyDecision{Action: action, Tags: []string{tag}}
+		case action == decision.Action && !slices.Contains(decision.Tags, tag):
+			decision.Tags = append(decision.Tags, tag)
+		}
+	}
+	return decision
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTagPolicy(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    TagPolicy
+		wantErr bool
+	}{
+		{value: "", want: TagPolicy{}},
+		{value: "bot=flag", want: TagPolicy{"bot": ActionFlag}},
+		{value: " bot = skip , blocked=reject,", want: TagPolicy{"bot": ActionSkip, "blocked": ActionReject}},
+		{value: "bot", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTagPolicy(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTagPolicy(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTagPolicy(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSetupPolicies(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name          string
+		defaultPolicy string
+		file          string
+		want          TagPolicies
+		wantErr       bool
+	}{
+		{
+			name:          "env only",
+			defaultPolicy: "bot=flag",
+			want:          TagPolicies{Default: TagPolicy{"bot": ActionFlag}},
+		},
+		{
+			name:          "file merged over env",
+			defaultPolicy: "bot=flag,blocked=reject",
+			file:          write("merge.json", `{"default": {"bot": "skip"}, "tenants": {"alice": {"internal": "allow"}}}`),
+			want: TagPolicies{
+				Default: TagPolicy{"bot": ActionSkip, "blocked": ActionReject},
+				Tenants: map[string]TagPolicy{"alice": {"internal": ActionAllow}},
+			},
+		},
+		{
+			name:          "tenant clears a default action",
+			defaultPolicy: "bot=skip",
+			file:          write("clear.json", `{"tenants": {"load-test": {"bot": "none"}}}`),
+			want: TagPolicies{
+				Default: TagPolicy{"bot": ActionSkip},
+				Tenants: map[string]TagPolicy{"load-test": {"bot": ActionClear}},
+			},
+		},
+		{name: "unknown default action", defaultPolicy: "bot=ban", wantErr: true},
+		{name: "empty action", defaultPolicy: "bot=", wantErr: true},
+		{name: "unknown tenant action", file: write("tenant.json", `{"tenants": {"alice": {"bot": "ban"}}}`), wantErr: true},
+		{name: "invalid json", file: write("invalid.json", `{"default":`), wantErr: true},
+		{name: "missing file", file: filepath.Join(dir, "missing.json"), wantErr: true},
+	}
+	saved := Policies
+	t.Cleanup(func() { Policies = saved })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Policies = TagPolicies{Default: TagPolicy{}}
+			err := SetupPolicies(tt.defaultPolicy, tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetupPolicies() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(Policies.Default) != 0 || Policies.Tenants != nil {
+					t.Errorf("SetupPolicies() installed %+v despite the error", Policies)
+				}
+				return
+			}
+			if !reflect.DeepEqual(Policies, tt.want) {
+				t.Errorf("Policies = %+v, want %+v", Policies, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecide(t *testing.T) {
+	policies := TagPolicies{
+		Default: TagPolicy{"bot": ActionFlag, "scraper": ActionFlag, "blocked": ActionReject, "internal": ActionSkip},
+		Tenants: map[string]TagPolicy{
+			"alice":     {"bot": ActionReject, "partner": ActionAllow},
+			"load-test": {"bot": ActionClear, "internal": ActionClear, "scraper": ActionSkip},
+		},
+	}
+	tests := []struct {
+		name   string
+		tenant string
+		tags   []string
+		want   PolicyDecision
+	}{
+		{name: "no tags", want: PolicyDecision{Action: ActionNone}},
+		{name: "unknown tag", tags: []string{"new"}, want: PolicyDecision{Action: ActionNone}},
+		{name: "one tag", tags: []string{"bot"}, want: PolicyDecision{Action: ActionFlag, Tags: []string{"bot"}}},
+		{name: "same action collects tags", tags: []string{"bot", "scraper", "bot"}, want: PolicyDecision{Action: ActionFlag, Tags: []string{"bot", "scraper"}}},
+		{name: "strongest action wins", tags: []string{"bot", "blocked", "internal"}, want: PolicyDecision{Action: ActionReject, Tags: []string{"blocked"}}},
+		{name: "tenant override", tenant: "alice", tags: []string{"bot"}, want: PolicyDecision{Action: ActionReject, Tags: []string{"bot"}}},
+		{name: "tenant inherits default", tenant: "alice", tags: []string{"internal"}, want: PolicyDecision{Action: ActionSkip, Tags: []string{"internal"}}},
+		{name: "allow overrides reject", tenant: "alice", tags: []string{"blocked", "partner"}, want: PolicyDecision{Action: ActionAllow, Tags: []string{"partner"}}},
+		{name: "other tenant's override ignored", tenant: "bob", tags: []string{"partner"}, want: PolicyDecision{Action: ActionNone}},
+		{name: "tenant clears default", tenant: "load-test", tags: []string{"bot", "internal"}, want: PolicyDecision{Action: ActionNone}},
+		{name: "cleared tag next to an active one", tenant: "load-test", tags: []string{"bot", "scraper"}, want: PolicyDecision{Action: ActionSkip, Tags: []string{"scraper"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policies.Decide(tt.tenant, tt.tags); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decide(%q, %v) = %+v, want %+v", tt.tenant, tt.tags, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Privacy modes control how a client IP is represented once it leaves the
+// request handler: Redis keys, Kafka and SQS payloads, and access logs.
+// Lookups to ip-info always use the real IP, which is only kept in memory.
+const (
+	PrivacyModeOff      = "off"
+	PrivacyModeHmac     = "hmac"
+	PrivacyModeTruncate = "truncate"
+)
+
+var privacyMode = PrivacyModeOff
+var privacyKey []byte
+
+// SetupPrivacy
+// Validate and install the IP anonymization policy
+func SetupPrivacy(mode, key string) error {
+	switch mode {
+	case "", PrivacyModeOff:
+		privacyMode = PrivacyModeOff
+	case PrivacyModeHmac:
+		if key == "" {
+			return errors.New("privacy mode hmac requires PRIVACYKEY to be set")
+		}
+		privacyMode = PrivacyModeHmac
+		privacyKey = []byte(key)
+	case PrivacyModeTruncate:
+		privacyMode = PrivacyModeTruncate
+	default:
+		return fmt.Errorf("unknown privacy mode %q", mode)
+	}
+	return nil
+}
+
+// AnonymizeIp
+// Apply the configured privacy policy to an IP address. With hmac the result is
+// a stable keyed hash, with truncate the address is cut to its /24 (IPv4) or
+// /48 (IPv6) network.
+func AnonymizeIp(ip string) string {
+	switch privacyMode {
+	case PrivacyModeHmac:
+		mac := hmac.New(sha256.New, privacyKey)
+		mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil))
+	case PrivacyModeTruncate:
+		return truncateIp(ip)
+	}
+	return ip
+}
+
+func truncateIp(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		// Never fall back to the raw value: it may still identify the client.
+		return "unknown"
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "unknown"
+	}
+	return prefix.Addr().String()
+}
+
+// privacyLogFormatter mirrors gin's default access log line, but with the
+// resolved client IP passed through the privacy policy.
+func privacyLogFormatter(param gin.LogFormatterParams) string {
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	if resolution, ok := param.Keys["client-ip"].(ClientIpResolution); ok {
+		param.ClientIP = resolution.Ip
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		AnonymizeIp(param.ClientIP),
+		param.Method,
+		param.Path,
+		param.ErrorMessage,
+	)
+}
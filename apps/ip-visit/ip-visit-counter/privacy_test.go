@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+// setPrivacy installs a privacy policy for one test.
+func setPrivacy(t *testing.T, mode, key string) {
+	t.Helper()
+	t.Cleanup(func() { privacyMode, privacyKey = PrivacyModeOff, nil })
+	if err := SetupPrivacy(mode, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetupPrivacy(t *testing.T) {
+	tests := []struct {
+		mode, key string
+		wantErr   bool
+	}{
+		{mode: "", wantErr: false},
+		{mode: PrivacyModeOff, wantErr: false},
+		{mode: PrivacyModeTruncate, wantErr: false},
+		{mode: PrivacyModeHmac, key: "secret", wantErr: false},
+		{mode: PrivacyModeHmac, wantErr: true},
+		{mode: "hash", wantErr: true},
+	}
+	t.Cleanup(func() { privacyMode, privacyKey = PrivacyModeOff, nil })
+	for _, tt := range tests {
+		err := SetupPrivacy(tt.mode, tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SetupPrivacy(%q, %q) error = %v, want error %v", tt.mode, tt.key, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAnonymizeIpTruncate(t *testing.T) {
+	setPrivacy(t, PrivacyModeTruncate, "")
+	tests := []struct{ ip, want string }{
+		{"203.0.113.77", "203.0.113.0"},
+		{"10.1.2.3", "10.1.2.0"},
+		{"::ffff:203.0.113.77", "203.0.113.0"},
+		{"2001:db8:abcd:12::1", "2001:db8:abcd::"},
+		{"not-an-ip", "unknown"},
+		{"", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := AnonymizeIp(tt.ip); got != tt.want {
+			t.Errorf("AnonymizeIp(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAnonymizeIpHmac(t *testing.T) {
+	setPrivacy(t, PrivacyModeHmac, "secret")
+	a := AnonymizeIp("203.0.113.77")
+	if len(a) != 64 {
+		t.Fatalf("AnonymizeIp() = %q, want a hex SHA-256", a)
+	}
+	if again := AnonymizeIp("203.0.113.77"); again != a {
+		t.Errorf("AnonymizeIp() not stable: %q then %q", a, again)
+	}
+	if other := AnonymizeIp("203.0.113.78"); other == a {
+		t.Errorf("AnonymizeIp() = %q for two different IPs", a)
+	}
+
+	setPrivacy(t, PrivacyModeHmac, "other-secret")
+	if rekeyed := AnonymizeIp("203.0.113.77"); rekeyed == a {
+		t.Errorf("AnonymizeIp() = %q under two different keys", a)
+	}
+}
+
+func TestAnonymizeIpOff(t *testing.T) {
+	setPrivacy(t, PrivacyModeOff, "")
+	if got := AnonymizeIp("203.0.113.77"); got != "203.0.113.77" {
+		t.Errorf("AnonymizeIp() = %q, want the IP unchanged", got)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis deployment modes. RedisModeAuto lets go-redis pick: a master name means
+// Sentinel, several addresses mean Cluster, otherwise a single node.
+const (
+	RedisModeAuto     = ""
+	RedisModeSingle   = "single"
+	RedisModeSentinel = "sentinel"
+	RedisModeCluster  = "cluster"
+)
+
+// RedisConfig
+// Connection settings for Redis. Explicit fields override values taken from Url.
+type RedisConfig struct {
+	// Address is one host:port, or a comma-separated seed list of cluster or
+	// sentinel nodes.
+	Address string
+	// Url is a redis:// or rediss:// connection URL, as an alternative to Address.
+	Url              string
+	Mode             string
+	MasterName       string
+	Username         string
+	Password         string
+	SentinelUsername string
+	SentinelPassword string
+	DB               int
+	Tls              bool
+	TlsCaFile        string
+	TlsSkipVerify    bool
+	// ConnectTimeout bounds how long startup waits for Redis to answer a PING.
+	ConnectTimeout time.Duration
+}
+
+// SetupRedis
+// Initialize the Redis client and wait until Redis is reachable
+func SetupRedis(cfg RedisConfig) error {
+	opts, err := redisOptions(cfg)
+	if err != nil {
+		return err
+	}
+
+	switch cfg.Mode {
+	case RedisModeAuto:
+		RedisClient = redis.NewUniversalClient(opts)
+	case RedisModeSingle:
+		RedisClient = redis.NewClient(opts.Simple())
+	case RedisModeSentinel:
+		if opts.MasterName == "" {
+			return fmt.Errorf("redis mode sentinel requires REDISMASTERNAME")
+		}
+		RedisClient = redis.NewFailoverClient(opts.Failover())
+	case RedisModeCluster:
+		// A single seed address is enough for a managed cluster endpoint, which
+		// NewUniversalClient would treat as a standalone node.
+		RedisClient = redis.NewClusterClient(opts.Cluster())
+	default:
+		return fmt.Errorf("unknown redis mode %q", cfg.Mode)
+	}
+
+	return waitForRedis(cfg.ConnectTimeout)
+}
+
+// waitForRedis pings Redis with backoff, so the counter can start before Redis
+// is ready instead of crash-looping.
+func waitForRedis(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := 500 * time.Millisecond
+	for {
+		err := RedisClient.Ping(ctx).Err()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("redis not reachable after %s: %w", timeout, err)
+		}
+		log.Printf("waiting for redis: %v (retrying in %s)", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
+
+func redisOptions(cfg RedisConfig) (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{}
+
+	if cfg.Url != "" {
+		parsed, err := redis.ParseURL(cfg.Url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis url: %w", err)
+		}
+		opts.Addrs = []string{parsed.Addr}
+		opts.Username = parsed.Username
+		opts.Password = parsed.Password
+		opts.DB = parsed.DB
+		opts.TLSConfig = parsed.TLSConfig
+	}
+
+	if addrs := splitList(cfg.Address); len(addrs) > 0 {
+		opts.Addrs = addrs
+	}
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("either REDISADDRESS or REDISURL must be set")
+	}
+	if cfg.Username != "" {
+		opts.Username = cfg.Username
+	}
+	if cfg.Password != "" {
+		opts.Password = cfg.Password
+	}
+	if cfg.DB != 0 {
+		opts.DB = cfg.DB
+	}
+	opts.MasterName = cfg.MasterName
+	opts.SentinelUsername = cfg.SentinelUsername
+	opts.SentinelPassword = cfg.SentinelPassword
+
+	if cfg.Tls || cfg.TlsCaFile != "" || cfg.TlsSkipVerify {
+		tlsConfig, err := redisTlsConfig(cfg, opts.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	return opts, nil
+}
+
+func redisTlsConfig(cfg RedisConfig, base *tls.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		tlsConfig = base.Clone()
+	}
+	if cfg.TlsCaFile != "" {
+		pem, err := os.ReadFile(cfg.TlsCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("read redis CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.TlsCaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	tlsConfig.InsecureSkipVerify = cfg.TlsSkipVerify
+	return tlsConfig, nil
+}
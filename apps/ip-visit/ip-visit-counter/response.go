@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ResponseData
+// Values available to the response text template
+type ResponseData struct {
+	Count  int64
+	Ip     string
+	Info   *IpInfo
+	Tenant string
+}
+
+// ResponseTemplates
+// Renders the response text from ResponseFile, or from a per-tenant override
+// file when one exists. Templates are parsed lazily and dropped whenever a
+// watched directory changes, so edits to a mounted ConfigMap apply live.
+type ResponseTemplates struct {
+	file string
+	// tenantPattern is a path containing "{tenant}", empty when per-tenant
+	// overrides are disabled.
+	tenantPattern string
+
+	mu      sync.Mutex
+	base    *template.Template
+	tenants map[string]*template.Template // tenants with an override file
+	missing map[string]struct{}           // tenants without one
+}
+
+// maxTenantTemplates caps the per-tenant cache. Past the cap, templates are
+// parsed on every request instead.
+const maxTenantTemplates = 256
+
+// maxMissingTenants caps the tenants remembered as having no override. The
+// tenant comes from the request, so the set is cleared when it fills up.
+const maxMissingTenants = 4096
+
+var Responses *ResponseTemplates
+
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// SetupResponses
+// Load the response template and start watching it for changes
+func SetupResponses(file, tenantPattern string) error {
+	if tenantPattern != "" && !strings.Contains(tenantPattern, "{tenant}") {
+		return fmt.Errorf("tenant response file %q must contain {tenant}", tenantPattern)
+	}
+	templates := &ResponseTemplates{file: file, tenantPattern: tenantPattern}
+	if err := templates.reload(); err != nil {
+		return err
+	}
+	Responses = templates
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// ConfigMap volumes are updated by swapping a symlinked directory, which
+	// never touches the file itself, so watch the parent directories instead.
+	dirs := map[string]bool{filepath.Dir(file): true}
+	if tenantPattern != "" {
+		dirs[filepath.Dir(tenantPattern)] = true
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("not watching %s for response changes: %v", dir, err)
+		}
+	}
+	go templates.watch(watcher)
+	return nil
+}
+
+func (t *ResponseTemplates) watch(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if err := t.reload(); err != nil {
+				// Keep serving the previous template until the file is valid again.
+				log.Printf("failed to reload response template: %v", err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("response template watcher error: %v", err)
+		}
+	}
+}
+
+// reload parses the base template again and drops the cached tenant
+// lookups, which the change may have added, removed or edited. When the base
+// template fails to parse, the previous one is kept.
+func (t *ResponseTemplates) reload() error {
+	base, err := parseResponseFile(t.file)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		t.base = base
+	}
+	t.tenants = map[string]*template.Template{}
+	t.missing = map[string]struct{}{}
+	return err
+}
+
+func parseResponseFile(file string) (*template.Template, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(filepath.Base(file)).Parse(string(content))
+}
+
+// lookup returns the tenant override when present, the base template otherwise.
+func (t *ResponseTemplates) lookup(tenant string) *template.Template {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tenantPattern == "" || !tenantNamePattern.MatchString(tenant) {
+		return t.base
+	}
+	if override, cached := t.tenants[tenant]; cached {
+		return override
+	}
+	if _, missing := t.missing[tenant]; missing {
+		return t.base
+	}
+	override, err := parseResponseFile(strings.ReplaceAll(t.tenantPattern, "{tenant}", tenant))
+	if errors.Is(err, fs.ErrNotExist) {
+		if len(t.missing) >= maxMissingTenants {
+			clear(t.missing)
+		}
+		t.missing[tenant] = struct{}{}
+		return t.base
+	}
+	if err != nil {
+		log.Printf("failed to load response template for tenant %s: %v", tenant, err)
+		return t.base
+	}
+	if len(t.tenants) < maxTenantTemplates {
+		t.tenants[tenant] = override
+	}
+	return override
+}
+
+// Render
+// Execute the template that applies to data.Tenant
+func (t *ResponseTemplates) Render(data ResponseData) (string, error) {
+	var out bytes.Buffer
+	if err := t.lookup(data.Tenant).Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestResponseTemplatesTenantOverride(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "response.txt")
+	if err := os.WriteFile(file, []byte("{{.Count}} visits"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	templates := &ResponseTemplates{file: file, tenantPattern: filepath.Join(dir, "{tenant}.txt")}
+	if err := templates.reload(); err != nil {
+		t.Fatal(err)
+	}
+	render := func(tenant string) string {
+		t.Helper()
+		text, err := templates.Render(ResponseData{Count: 3, Tenant: tenant})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return text
+	}
+
+	if got := render("alice"); got != "3 visits" {
+		t.Errorf("alice without an override = %q", got)
+	}
+	if _, missing := templates.missing["alice"]; !missing {
+		t.Error("alice not cached as missing an override")
+	}
+
+	// The missing entry is only dropped when the watcher reloads.
+	if err := os.WriteFile(filepath.Join(dir, "alice.txt"), []byte("alice: {{.Count}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := render("alice"); got != "3 visits" {
+		t.Errorf("alice before reload = %q, want the cached default", got)
+	}
+	if err := templates.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := render("alice"); got != "alice: 3" {
+		t.Errorf("alice after reload = %q", got)
+	}
+
+	// A broken base template keeps the previous one but still drops tenants.
+	if err := os.WriteFile(file, []byte("{{.Count"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "alice.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := templates.reload(); err == nil {
+		t.Fatal("reload() of a broken template succeeded")
+	}
+	if got := render("alice"); got != "3 visits" {
+		t.Errorf("alice after its override was removed = %q", got)
+	}
+}
+
+func TestResponseTemplatesMissingCap(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "response.txt")
+	if err := os.WriteFile(file, []byte("hi"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	templates := &ResponseTemplates{file: file, tenantPattern: filepath.Join(dir, "{tenant}.txt")}
+	if err := templates.reload(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range maxMissingTenants + 1 {
+		templates.lookup("tenant-" + strconv.Itoa(i))
+	}
+	if got := len(templates.missing); got > maxMissingTenants {
+		t.Errorf("remembering %d missing tenants, want at most %d", got, maxMissingTenants)
+	}
+}
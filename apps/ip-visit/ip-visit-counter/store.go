@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Storage backends for visit counts, selected with STORE.
+const (
+	StoreRedis    = "redis"
+	StorePostgres = "postgres"
+	StoreMemory   = "memory"
+)
+
+// VisitStore
+// Counts visits per visitor (the anonymized IP) with a sliding TTL, and
+// answers the analytics shown next to the count.
+type VisitStore interface {
+	// Increment bumps the visitor's count, resets its TTL and returns the new count.
+	Increment(ctx context.Context, visitor string, ttl time.Duration) (int64, error)
+	// Count returns the visitor's live count without changing it.
+	Count(ctx context.Context, visitor string) (int64, error)
+	// UniqueVisitors returns how many visitors currently have a live count.
+	UniqueVisitors(ctx context.Context) (int64, error)
+
+	// ClaimIdempotencyKey reserves key for window. When the key is already
+	// taken it returns false and the response saved for it, which is nil while
+	// the first request is still in flight.
+	ClaimIdempotencyKey(ctx context.Context, key string, window time.Duration) (bool, []byte, error)
+	// SaveIdempotentResponse stores the response replayed for a claimed key.
+	SaveIdempotentResponse(ctx context.Context, key string, response []byte, window time.Duration) error
+	// ReleaseIdempotencyKey drops a claim so the request can be retried.
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+	Close() error
+}
+
+var Store VisitStore
+
+// SetupStore
+// Initialize the configured visit store
+func SetupStore(config Config) error {
+	switch config.Store {
+	case "", StoreRedis:
+		if err := SetupRedis(config.Redis); err != nil {
+			return fmt.Errorf("unable to connect to redis, %w", err)
+		}
+		Store = NewRedisStore(RedisClient)
+	case StorePostgres:
+		store, err := NewPostgresStore(ctx, config.DatabaseUrl)
+		if err != nil {
+			return fmt.Errorf("unable to set up postgres store, %w", err)
+		}
+		Store = store
+	case StoreMemory:
+		Store = NewMemoryStore()
+	default:
+		return fmt.Errorf("unknown store %q", config.Store)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore
+// In-process visit store, for running the counter locally without any infra.
+// Counts are lost on restart and are not shared between replicas.
+type MemoryStore struct {
+	mu          sync.Mutex
+	visitors    map[string]*memoryCount
+	idempotency map[string]*memoryResponse
+}
+
+type memoryCount struct {
+	count   int64
+	expires time.Time
+}
+
+type memoryResponse struct {
+	response []byte
+	expires  time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		visitors:    map[string]*memoryCount{},
+		idempotency: map[string]*memoryResponse{},
+	}
+}
+
+func (s *MemoryStore) Increment(_ context.Context, visitor string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	entry, ok := s.visitors[visitor]
+	if !ok || now.After(entry.expires) {
+		entry = &memoryCount{}
+		s.visitors[visitor] = entry
+	}
+	entry.count++
+	entry.expires = now.Add(ttl)
+	return entry.count, nil
+}
+
+func (s *MemoryStore) Count(_ context.Context, visitor string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.visitors[visitor]
+	if !ok || time.Now().After(entry.expires) {
+		return 0, nil
+	}
+	return entry.count, nil
+}
+
+func (s *MemoryStore) UniqueVisitors(_ context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for visitor, entry := range s.visitors {
+		if now.After(entry.expires) {
+			delete(s.visitors, visitor)
+		}
+	}
+	return int64(len(s.visitors)), nil
+}
+
+func (s *MemoryStore) ClaimIdempotencyKey(_ context.Context, key string, window time.Duration) (bool, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, entry := range s.idempotency {
+		if now.After(entry.expires) {
+			delete(s.idempotency, k)
+		}
+	}
+	if entry, ok := s.idempotency[key]; ok {
+		return false, entry.response, nil
+	}
+	s.idempotency[key] = &memoryResponse{expires: now.Add(window)}
+	return true, nil, nil
+}
+
+func (s *MemoryStore) SaveIdempotentResponse(_ context.Context, key string, response []byte, window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idempotency[key] = &memoryResponse{response: response, expires: time.Now().Add(window)}
+	return nil
+}
+
+func (s *MemoryStore) ReleaseIdempotencyKey(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.idempotency, key)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
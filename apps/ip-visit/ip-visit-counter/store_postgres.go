@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore
+// Keeps visit counts in the ip_visit_counts table. Expired rows are ignored by
+// every query and restart from 1 on the next visit.
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresStore connects to Postgres and ensures the counts table exists.
+func NewPostgresStore(ctx context.Context, url string) (*PostgresStore, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS ip_visit_counts (
+		visitor text PRIMARY KEY,
+		count bigint NOT NULL,
+		expires_at timestamptz NOT NULL
+	)`); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	// response is NULL while the first request for a key is still in flight.
+	if _, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS ip_visit_idempotency (
+		key text PRIMARY KEY,
+		response bytea,
+		expires_at timestamptz NOT NULL
+	)`); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &PostgresStore{pool: pool}, nil
+}
+
+func (s *PostgresStore) Increment(ctx context.Context, visitor string, ttl time.Duration) (int64, error) {
+	var count int64
+	err := s.pool.QueryRow(ctx, `
+		INSERT INTO ip_visit_counts (visitor, count, expires_at) VALUES ($1, 1, now() + $2 * interval '1 second')
+		ON CONFLICT (visitor) DO UPDATE SET
+			count = CASE WHEN ip_visit_counts.expires_at < now() THEN 1 ELSE ip_visit_counts.count + 1 END,
+			expires_at = EXCLUDED.expires_at
+		RETURNING count`, visitor, int64(ttl.Seconds())).Scan(&count)
+	return count, err
+}
+
+func (s *PostgresStore) Count(ctx context.Context, visitor string) (int64, error) {
+	var count int64
+	err := s.pool.QueryRow(ctx, `
+		SELECT count FROM ip_visit_counts WHERE visitor = $1 AND expires_at >= now()`, visitor).Scan(&count)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	return count, err
+}
+
+func (s *PostgresStore) UniqueVisitors(ctx context.Context) (int64, error) {
+	// Expired rows are pruned here rather than by a separate sweeper.
+	if _, err := s.pool.Exec(ctx, `DELETE FROM ip_visit_counts WHERE expires_at < now()`); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := s.pool.QueryRow(ctx, `SELECT count(*) FROM ip_visit_counts`).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresStore) ClaimIdempotencyKey(ctx context.Context, key string, window time.Duration) (bool, []byte, error) {
+	if _, err := s.pool.Exec(ctx, `DELETE FROM ip_visit_idempotency WHERE expires_at < now()`); err != nil {
+		return false, nil, err
+	}
+	tag, err := s.pool.Exec(ctx, `
+		INSERT INTO ip_visit_idempotency (key, expires_at) VALUES ($1, now() + $2 * interval '1 second')
+		ON CONFLICT (key) DO NOTHING`, key, int64(window.Seconds()))
+	if err != nil {
+		return false, nil, err
+	}
+	if tag.RowsAffected() == 1 {
+		return true, nil, nil
+	}
+	var response []byte
+	err = s.pool.QueryRow(ctx, `SELECT response FROM ip_visit_idempotency WHERE key = $1`, key).Scan(&response)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil, nil
+	}
+	return false, response, err
+}
+
+func (s *PostgresStore) SaveIdempotentResponse(ctx context.Context, key string, response []byte, window time.Duration) error {
+	_, err := s.pool.Exec(ctx, `
+		UPDATE ip_visit_idempotency SET response = $2, expires_at = now() + $3 * interval '1 second'
+		WHERE key = $1`, key, response, int64(window.Seconds()))
+	return err
+}
+
+func (s *PostgresStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM ip_visit_idempotency WHERE key = $1`, key)
+	return err
+}
+
+func (s *PostgresStore) Close() error {
+	s.pool.Close()
+	return nil
+}
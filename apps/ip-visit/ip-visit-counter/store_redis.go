@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore
+// Keeps one counter key per visitor, plus a sorted set of visitors scored by
+// expiry time so unique visitors can be counted without a keyspace scan.
+type RedisStore struct {
+	client redis.UniversalClient
+}
+
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func (s *RedisStore) visitorsKey() string {
+	return RedisKey + "visitors"
+}
+
+func (s *RedisStore) Increment(ctx context.Context, visitor string, ttl time.Duration) (int64, error) {
+	key := RedisKey + visitor
+	count, err := s.client.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	s.client.Expire(ctx, key, ttl)
+	s.client.ZAdd(ctx, s.visitorsKey(), redis.Z{
+		Score:  float64(time.Now().Add(ttl).Unix()),
+		Member: visitor,
+	})
+	return count, nil
+}
+
+func (s *RedisStore) Count(ctx context.Context, visitor string) (int64, error) {
+	count, err := s.client.Get(ctx, RedisKey+visitor).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return count, err
+}
+
+func (s *RedisStore) UniqueVisitors(ctx context.Context) (int64, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := s.client.ZRemRangeByScore(ctx, s.visitorsKey(), "-inf", "("+now).Err(); err != nil {
+		return 0, err
+	}
+	return s.client.ZCard(ctx, s.visitorsKey()).Result()
+}
+
+func (s *RedisStore) idempotencyKey(key string) string {
+	return RedisKey + "idempotency-" + key
+}
+
+// An empty value marks a claimed key whose response isn't saved yet.
+func (s *RedisStore) ClaimIdempotencyKey(ctx context.Context, key string, window time.Duration) (bool, []byte, error) {
+	claimed, err := s.client.SetNX(ctx, s.idempotencyKey(key), "", window).Result()
+	if err != nil || claimed {
+		return claimed, nil, err
+	}
+	response, err := s.client.Get(ctx, s.idempotencyKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// Expired or released between the two calls; try once more.
+		claimed, err = s.client.SetNX(ctx, s.idempotencyKey(key), "", window).Result()
+		return claimed, nil, err
+	}
+	if err != nil || len(response) == 0 {
+		return false, nil, err
+	}
+	return false, response, nil
+}
+
+func (s *RedisStore) SaveIdempotentResponse(ctx context.Context, key string, response []byte, window time.Duration) error {
+	return s.client.Set(ctx, s.idempotencyKey(key), response, window).Err()
+}
+
+func (s *RedisStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.idempotencyKey(key)).Err()
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
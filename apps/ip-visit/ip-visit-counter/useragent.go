@@ -0,0 +1,41 @@
+package main
+
+import "strings"
+
+// Client classes for a visit's User-Agent.
+const (
+	ClientBrowser = "browser"
+	ClientBot     = "bot"
+	ClientCli     = "cli"
+	ClientUnknown = "unknown"
+)
+
+// Substrings (lowercase) that mark automated clients. Checked before
+// browsers, since most crawlers also claim to be Mozilla.
+var botMarkers = []string{"bot", "crawler", "spider", "slurp", "kube-probe", "headlesschrome", "lighthouse", "monitor"}
+
+// Prefixes (lowercase) of command-line tools and HTTP libraries.
+var cliPrefixes = []string{"curl/", "wget/", "httpie/", "python-requests/", "python-urllib/", "go-http-client/", "postmanruntime/", "okhttp/", "node-fetch/", "axios/"}
+
+// classifyUserAgent
+// Roughly classify a User-Agent header as browser, bot or CLI
+func classifyUserAgent(userAgent string) string {
+	ua := strings.ToLower(strings.TrimSpace(userAgent))
+	if ua == "" {
+		return ClientUnknown
+	}
+	for _, marker := range botMarkers {
+		if strings.Contains(ua, marker) {
+			return ClientBot
+		}
+	}
+	for _, prefix := range cliPrefixes {
+		if strings.HasPrefix(ua, prefix) {
+			return ClientCli
+		}
+	}
+	if strings.HasPrefix(ua, "mozilla/") || strings.HasPrefix(ua, "opera/") {
+		return ClientBrowser
+	}
+	return ClientUnknown
+}
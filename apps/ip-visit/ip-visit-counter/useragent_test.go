@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestClassifyUserAgent(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{"", ClientUnknown},
+		{"   ", ClientUnknown},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_5) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15", ClientBrowser},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:128.0) Gecko/20100101 Firefox/128.0", ClientBrowser},
+		{"Opera/9.80 (Windows NT 6.1) Presto/2.12.388 Version/12.18", ClientBrowser},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", ClientBot},
+		{"Mozilla/5.0 (compatible; Yahoo! Slurp; http://help.yahoo.com/help/us/ysearch/slurp)", ClientBot},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/126.0.0.0 Safari/537.36", ClientBot},
+		{"kube-probe/1.30", ClientBot},
+		{"UptimeRobot/2.0; Monitor", ClientBot},
+		{"curl/8.7.1", ClientCli},
+		{"Wget/1.21.4", ClientCli},
+		{"python-requests/2.32.3", ClientCli},
+		{"Go-http-client/1.1", ClientCli},
+		{"PostmanRuntime/7.39.0", ClientCli},
+		{"my-script 1.0", ClientUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyUserAgent(tt.userAgent); got != tt.want {
+			t.Errorf("classifyUserAgent(%q) = %q, want %q", tt.userAgent, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Visit
+// The visitor behind a request, resolved once per handler
+type Visit struct {
+	ClientIp ClientIpResolution
+	// Ip is the real client IP. It is only used for ip-info lookups.
+	Ip string
+	// VisitorIp is Ip after the privacy policy; this is what leaves the handler.
+	VisitorIp string
+	Tenant    string
+	EventId   string
+	Timestamp time.Time
+	Path      string
+	UserAgent string
+	Referer   string
+	// Baggage is the incoming W3C baggage header, forwarded on published events.
+	Baggage string
+
+	// Set by enrichVisit.
+	Info     *IpInfo
+	Info2    *IpInfo
+	Decision PolicyDecision
+}
+
+// CountResponse
+// Body returned by GET /count and POST /visits
+type CountResponse struct {
+	Count      int64           `json:"count"`
+	UniqueIps  int64           `json:"unique_ips"`
+	Text       string          `json:"text"`
+	Info       *IpInfo         `json:"info"`
+	Info2      *IpInfo         `json:"info2"`
+	DemoMarker string          `json:"demo_marker"`
+	Decision   *PolicyDecision `json:"decision,omitempty"`
+	Debug      gin.H           `json:"debug,omitempty"`
+}
+
+// errVisitRejected is returned for visitors whose tags map to ActionReject.
+var errVisitRejected = errors.New("visit rejected by tag policy")
+
+// publishError is returned by recordVisit when the visit was counted but
+// could not be published; a retry must not count it again.
+type publishError struct {
+	count int64
+	err   error
+}
+
+func (e *publishError) Error() string {
+	return fmt.Sprintf("visit counted but not published: %v", e.err)
+}
+
+func (e *publishError) Unwrap() error {
+	return e.err
+}
+
+func newVisit(c *gin.Context) Visit {
+	clientIp := resolvedClientIp(c)
+	// header propagation
+	tenant := c.GetHeader("x-pg-tenant")
+	if tenant != "" {
+		c.Set("x-pg-tenant", tenant)
+	}
+	return Visit{
+		ClientIp:  clientIp,
+		Ip:        clientIp.Ip,
+		VisitorIp: AnonymizeIp(clientIp.Ip),
+		Tenant:    tenant,
+		EventId:   newEventId(),
+		Timestamp: time.Now().UTC(),
+		Path:      c.Request.URL.Path,
+		UserAgent: c.Request.UserAgent(),
+		Referer:   c.Request.Referer(),
+		Baggage:   c.GetHeader("baggage"),
+	}
+}
+
+func newEventId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// PublicInfo returns the ip-info enrichment with its IP replaced by the
+// anonymized one, for anything that leaves the handler.
+func (v *Visit) PublicInfo() *IpInfo {
+	return v.public(v.Info)
+}
+
+// PublicInfo2 is PublicInfo for the ip-info-grpc enrichment.
+func (v *Visit) PublicInfo2() *IpInfo {
+	return v.public(v.Info2)
+}
+
+func (v *Visit) public(info *IpInfo) *IpInfo {
+	if info == nil {
+		return nil
+	}
+	public := *info
+	public.Ip = v.VisitorIp
+	return &public
+}
+
+// Message builds the published visit event.
+func (v *Visit) Message() IpMessage {
+	return IpMessage{
+		Version:   IpMessageVersion,
+		EventId:   v.EventId,
+		Timestamp: v.Timestamp,
+		Ip:        v.VisitorIp,
+		Tenant:    v.Tenant,
+		Path:      v.Path,
+		UserAgent: v.UserAgent,
+		Referer:   v.Referer,
+		Client:    classifyUserAgent(v.UserAgent),
+		Info:      v.PublicInfo(),
+		Info2:     v.PublicInfo2(),
+		Decision:  v.Decision.Action,
+		Tags:      v.Decision.Tags,
+	}
+}
+
+func demoMarker(tenant string) string {
+	if tenant != "" {
+		return tenant
+	}
+	return "production"
+}
+
+// enrichVisit looks the visitor up in ip-info and ip-info-grpc and applies
+// the tenant's tag policy to the tags either of them returned. A lookup whose
+// address is not set is skipped, so the counter also runs without them.
+func enrichVisit(c *gin.Context, visit *Visit) error {
+	var err error
+	var tags []string
+	if IpInfoGrpcAddress != "" {
+		visit.Info2, err = getIpInfoGrpc(visit.Ip, c)
+		if err != nil {
+			return err
+		}
+		tags = append(tags, visit.Info2.Tags...)
+	}
+	if IpInfoAddress != "" {
+		visit.Info, err = getIpInfoHttp(visit.Ip, c)
+		if err != nil {
+			return err
+		}
+		tags = append(tags, visit.Info.Tags...)
+	}
+
+	slices.Sort(tags)
+	visit.Decision = Policies.Decide(visit.Tenant, slices.Compact(tags))
+	if visit.Decision.Action != ActionNone {
+		log.Printf("visit policy: tenant=%q visitor=%s action=%s tags=%v",
+			visit.Tenant, visit.VisitorIp, visit.Decision.Action, visit.Decision.Tags)
+	}
+	return nil
+}
+
+// recordVisit counts the visit and publishes it to SQS and Kafka. Visits the
+// policy skips are only read, not counted or published.
+func recordVisit(c *gin.Context, visit *Visit) (int64, error) {
+	if visit.Decision.Action == ActionSkip {
+		return Store.Count(c, visit.VisitorIp)
+	}
+
+	count, err := Store.Increment(c, visit.VisitorIp, RedisKeyTtl)
+	if err != nil {
+		return 0, err
+	}
+	LogVisit(c, visit)
+
+	if sqsClient != nil {
+		err = SendSqsMessage(c, visit)
+		if err != nil {
+			return count, &publishError{count: count, err: err}
+		}
+	}
+
+	if KafkaWriter != nil {
+		err = SendKafkaMessage(c, visit)
+		if err != nil {
+			return count, &publishError{count: count, err: err}
+		}
+	}
+
+	Feed.Publish(c, VisitEvent{Ip: visit.VisitorIp, Tenant: visit.Tenant, Count: count, Info: visit.PublicInfo(), Decision: visit.Decision.Action, TS: visit.Timestamp.UnixMilli()})
+	return count, nil
+}
+
+// countResponse builds the response body for an enriched visit.
+func countResponse(c *gin.Context, visit *Visit, count int64) (*CountResponse, error) {
+	uniqueIps, err := Store.UniqueVisitors(c)
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := Responses.Render(ResponseData{Count: count, Ip: visit.Ip, Info: visit.Info, Tenant: visit.Tenant})
+	if err != nil {
+		log.Printf("failed to render response template: %v", err)
+		return nil, err
+	}
+
+	response := &CountResponse{
+		Count:      count,
+		UniqueIps:  uniqueIps,
+		Text:       text,
+		Info:       visit.Info,
+		Info2:      visit.Info2,
+		DemoMarker: demoMarker(visit.Tenant),
+	}
+	if visit.Decision.Action != ActionNone {
+		response.Decision = &visit.Decision
+	}
+	if DebugResponse {
+		response.Debug = gin.H{"client_ip": visit.ClientIp}
+	}
+	return response, nil
+}
+
+// replayResponse is response as stored for Idempotency-Key replays: it
+// outlives the request, so it carries the anonymized IP only.
+func replayResponse(visit *Visit, response *CountResponse) *CountResponse {
+	replay := *response
+	replay.Info = visit.PublicInfo()
+	replay.Info2 = visit.PublicInfo2()
+	if privacyMode != PrivacyModeOff {
+		replay.Debug = nil
+		text, err := Responses.Render(ResponseData{Count: response.Count, Ip: visit.VisitorIp, Info: replay.Info, Tenant: visit.Tenant})
+		if err != nil {
+			log.Printf("failed to render replayed response template: %v", err)
+			text = ""
+		}
+		replay.Text = text
+	}
+	return &replay
+}
+
+// handleVisit enriches, records and builds the response for a visit.
+func handleVisit(c *gin.Context, visit *Visit) (*CountResponse, error) {
+	if err := enrichVisit(c, visit); err != nil {
+		return nil, err
+	}
+	if visit.Decision.Action == ActionReject {
+		return nil, errVisitRejected
+	}
+	count, err := recordVisit(c, visit)
+	if err != nil {
+		return nil, err
+	}
+	return countResponse(c, visit, count)
+}
+
+func abortVisit(c *gin.Context, visit *Visit, err error) {
+	if errors.Is(err, errVisitRejected) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Visit rejected", "decision": visit.Decision})
+		return
+	}
+	log.Printf("visit failed: %v", err)
+	c.JSON(500, gin.H{"error": "Internal server error"})
+}
+
+// getCount serves GET /count. It is a read-only view of the visitor's count,
+// unless LegacyCount restores the old behavior of recording a visit.
+func getCount(c *gin.Context) {
+	visit := newVisit(c)
+
+	if LegacyCount {
+		response, err := handleVisit(c, &visit)
+		if err != nil {
+			abortVisit(c, &visit, err)
+			return
+		}
+		c.JSON(200, response)
+		return
+	}
+
+	if err := enrichVisit(c, &visit); err != nil {
+		abortVisit(c, &visit, err)
+		return
+	}
+	if visit.Decision.Action == ActionReject {
+		abortVisit(c, &visit, errVisitRejected)
+		return
+	}
+	count, err := Store.Count(c, visit.VisitorIp)
+	if err != nil {
+		abortVisit(c, &visit, err)
+		return
+	}
+	response, err := countResponse(c, &visit, count)
+	if err != nil {
+		abortVisit(c, &visit, err)
+		return
+	}
+	c.JSON(200, response)
+}
+
+// postVisit serves POST /visits. With an Idempotency-Key header, repeats of
+// the same request within IdempotencyWindow replay the first response instead
+// of counting and publishing again.
+func postVisit(c *gin.Context) {
+	visit := newVisit(c)
+	// The page the visitor is on, when the frontend reports it.
+	var request struct {
+		Path string `json:"path"`
+	}
+	if c.ShouldBindJSON(&request) == nil && request.Path != "" {
+		visit.Path = request.Path
+	}
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+
+	if idempotencyKey == "" {
+		response, err := handleVisit(c, &visit)
+		if err != nil {
+			abortVisit(c, &visit, err)
+			return
+		}
+		c.JSON(http.StatusCreated, response)
+		return
+	}
+
+	// Keys are scoped to the visitor so clients can't collide with each other.
+	key := visit.VisitorIp + ":" + idempotencyKey
+	claimed, stored, err := Store.ClaimIdempotencyKey(c, key, IdempotencyWindow)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Internal server error"})
+		return
+	}
+	if !claimed {
+		if stored == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+			return
+		}
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(http.StatusCreated, "application/json; charset=utf-8", stored)
+		return
+	}
+
+	err = enrichVisit(c, &visit)
+	if err == nil && visit.Decision.Action == ActionReject {
+		err = errVisitRejected
+	}
+	var count int64
+	if err == nil {
+		count, err = recordVisit(c, &visit)
+	}
+	var notPublished *publishError
+	if err != nil && !errors.As(err, &notPublished) {
+		// Nothing was applied yet; let the client retry with the same key.
+		if releaseErr := Store.ReleaseIdempotencyKey(c, key); releaseErr != nil {
+			log.Printf("failed to release idempotency key: %v", releaseErr)
+		}
+		abortVisit(c, &visit, err)
+		return
+	}
+
+	// The visit is counted from here on, so the key stays claimed and a retry
+	// replays this response instead of counting again.
+	response, responseErr := countResponse(c, &visit, count)
+	if responseErr != nil {
+		log.Printf("failed to build visit response: %v", responseErr)
+		response = &CountResponse{Count: count, Info: visit.Info, Info2: visit.Info2, DemoMarker: demoMarker(visit.Tenant)}
+	}
+
+	body, _ := json.Marshal(replayResponse(&visit, response))
+	if err := Store.SaveIdempotentResponse(c, key, body, IdempotencyWindow); err != nil {
+		log.Printf("failed to save idempotent response: %v", err)
+	}
+	if notPublished != nil {
+		abortVisit(c, &visit, err)
+		return
+	}
+	c.JSON(http.StatusCreated, response)
+}
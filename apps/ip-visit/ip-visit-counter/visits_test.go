@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/segmentio/kafka-go"
+)
+
+const visitorIp = "203.0.113.7"
+
+// setupVisits runs the counter's visit handlers against a memory store and a
+// fake ip-info that echoes the IP it is asked about.
+func setupVisits(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	ipInfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(IpInfo{Ip: strings.TrimPrefix(r.URL.Path, "/ip/"), Info: "Test visitor"})
+	}))
+	t.Cleanup(ipInfo.Close)
+
+	file := filepath.Join(t.TempDir(), "response.txt")
+	if err := os.WriteFile(file, []byte("Visit {{.Count}} from {{.Ip}}{{with .Info}} ({{.Ip}}){{end}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetupResponses(file, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	savedStore, savedIpInfo, savedDebug, savedKafka := Store, IpInfoAddress, DebugResponse, KafkaWriter
+	t.Cleanup(func() {
+		Store, IpInfoAddress, DebugResponse, KafkaWriter = savedStore, savedIpInfo, savedDebug, savedKafka
+	})
+	Store = NewMemoryStore()
+	IpInfoAddress = ipInfo.URL
+	DebugResponse = true
+	KafkaWriter = nil
+	SetupFeed(nil)
+
+	router := gin.New()
+	router.Use(clientIpMiddleware)
+	router.POST("/visits", postVisit)
+	return router
+}
+
+func postVisitRequest(router *gin.Engine, idempotencyKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/visits", nil)
+	req.RemoteAddr = visitorIp + ":4711"
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPostVisitStoresNoRawIp(t *testing.T) {
+	router := setupVisits(t)
+	setPrivacy(t, PrivacyModeHmac, "secret")
+
+	w := postVisitRequest(router, "key-1")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /visits = %d %s", w.Code, w.Body)
+	}
+	// The visitor gets their own IP back, but it must not be persisted.
+	if !strings.Contains(w.Body.String(), visitorIp) {
+		t.Fatalf("response %s doesn't show the visitor's IP; the test no longer covers it", w.Body)
+	}
+
+	store := Store.(*MemoryStore)
+	if len(store.idempotency) != 1 {
+		t.Fatalf("stored %d idempotent responses, want 1", len(store.idempotency))
+	}
+	for key, entry := range store.idempotency {
+		if strings.Contains(key, visitorIp) || strings.Contains(string(entry.response), visitorIp) {
+			t.Errorf("raw IP stored under %q: %s", key, entry.response)
+		}
+	}
+
+	replay := postVisitRequest(router, "key-1")
+	if replay.Code != http.StatusCreated || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("replay = %d %s", replay.Code, replay.Body)
+	}
+	var response CountResponse
+	if err := json.Unmarshal(replay.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Count != 1 || response.Info == nil || response.Info.Ip != AnonymizeIp(visitorIp) {
+		t.Errorf("replayed %+v, want count 1 and the anonymized IP", response)
+	}
+}
+
+func TestPostVisitKeepsClaimWhenPublishFails(t *testing.T) {
+	router := setupVisits(t)
+	KafkaWriter = &kafka.Writer{Addr: kafka.TCP("127.0.0.1:1"), Topic: "visits", MaxAttempts: 1}
+
+	if w := postVisitRequest(router, "key-1"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("POST /visits with Kafka down = %d %s, want 500", w.Code, w.Body)
+	}
+
+	// The visit was counted before the publish failed, so a retry must not
+	// count it again.
+	KafkaWriter = nil
+	retry := postVisitRequest(router, "key-1")
+	if retry.Code != http.StatusCreated || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry = %d %s, want a replay", retry.Code, retry.Body)
+	}
+	count, err := Store.Count(context.Background(), visitorIp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("count = %d after a retry, want 1", count)
+	}
+}
+
+func TestPostVisitReleasesClaimWhenNothingApplied(t *testing.T) {
+	router := setupVisits(t)
+	IpInfoAddress = "http://127.0.0.1:1"
+
+	if w := postVisitRequest(router, "key-1"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("POST /visits with ip-info down = %d %s, want 500", w.Code, w.Body)
+	}
+	if len(Store.(*MemoryStore).idempotency) != 0 {
+		t.Error("key still claimed after a request that counted nothing")
+	}
+}
+
+func TestVisitMessageEnrichment(t *testing.T) {
+	setPrivacy(t, PrivacyModeTruncate, "")
+	visit := Visit{
+		Ip:        visitorIp,
+		VisitorIp: AnonymizeIp(visitorIp),
+		Info:      &IpInfo{Ip: visitorIp, Info: "Test visitor"},
+		Info2:     &IpInfo{Ip: visitorIp, Info: "Test visitor", Tags: []string{"internal"}},
+	}
+
+	message := visit.Message()
+	if message.Info == nil || message.Info2 == nil {
+		t.Fatalf("Message() = %+v, want both enrichments", message)
+	}
+	for name, info := range map[string]*IpInfo{"info": message.Info, "info2": message.Info2} {
+		if info.Ip != "203.0.113.0" {
+			t.Errorf("%s.ip = %q, want the truncated IP", name, info.Ip)
+		}
+	}
+	if visit.Info2.Ip != visitorIp {
+		t.Error("Message() changed the visit's own enrichment")
+	}
+}
@@ -3,8 +3,14 @@
 import { IPInfo } from "@/components/ipinfo"
 import useSWR from 'swr'
 
+// One key per page load: SWR revalidations and retries replay the same visit
+// instead of counting it again.
+const idempotencyKey = crypto.randomUUID()
+
 const fetcher = (url: string) => fetch(url, {
-  method: 'GET',
+  method: 'POST',
+  headers: { 'Idempotency-Key': idempotencyKey, 'Content-Type': 'application/json' },
+  body: JSON.stringify({ path: window.location.pathname }),
 }).then(res => {
   console.log(res);
   return res.json();
@@ -12,7 +18,7 @@ const fetcher = (url: string) => fetch(url, {
 
 
 export default function Home() {
-  const { data, error, isLoading } = useSWR("https://playground.metalbear.dev/count", fetcher)
+  const { data, error, isLoading } = useSWR("https://playground.metalbear.dev/visits", fetcher)
 
   if (error) {
     console.log(error);
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/metalbear-co/playground/internal/health"
+	"github.com/segmentio/kafka-go"
+)
+
+// Modes of the binary, selected with MODE.
+const (
+	ModeConsume    = "consume"
+	ModeSqsToKafka = "sqs-to-kafka"
+	ModeKafkaToSqs = "kafka-to-sqs"
+)
+
+// CloudEvents media type of a structured-mode SQS body.
+const cloudEventsContentType = "application/cloudevents+json"
+
+// SQS allows 10 attributes per message; the rest of a record's headers are dropped.
+const maxSqsAttributes = 10
+
+var KafkaWriter *kafka.Writer
+
+// SetupKafkaWriter
+// Initialize the Kafka writer the SQS-to-Kafka bridge forwards to
+func SetupKafkaWriter(address, topic string) {
+	KafkaWriter = &kafka.Writer{
+		Addr:     kafka.TCP(address),
+		Topic:    topic,
+		Balancer: &kafka.LeastBytes{},
+	}
+}
+
+// SqsToKafka
+// Translate an SQS message into the Kafka record ip-visit-counter would have
+// produced: a structured-mode CloudEvent becomes binary mode (the data as the
+// value, attributes as ce_ headers), and message attributes such as
+// x-pg-tenant and baggage become headers.
+func SqsToKafka(message types.Message) kafka.Message {
+	record := kafka.Message{Value: []byte(aws.ToString(message.Body))}
+	for key, value := range message.MessageAttributes {
+		if key == "content-type" || value.StringValue == nil {
+			continue
+		}
+		record.Headers = append(record.Headers, kafka.Header{Key: key, Value: []byte(*value.StringValue)})
+	}
+
+	_, envelope, err := DecodeVisit(message)
+	if err != nil || envelope == nil {
+		return record
+	}
+	record.Value = envelope.Data
+	record.Headers = append(record.Headers,
+		kafka.Header{Key: "ce_specversion", Value: []byte(envelope.SpecVersion)},
+		kafka.Header{Key: "ce_id", Value: []byte(envelope.Id)},
+		kafka.Header{Key: "ce_source", Value: []byte(envelope.Source)},
+		kafka.Header{Key: "ce_type", Value: []byte(envelope.Type)},
+		kafka.Header{Key: "ce_time", Value: []byte(envelope.Time.Format(time.RFC3339Nano))},
+		kafka.Header{Key: "content-type", Value: []byte(envelope.DataContentType)},
+	)
+	if envelope.Tenant != "" {
+		record.Headers = append(record.Headers, kafka.Header{Key: "ce_tenant", Value: []byte(envelope.Tenant)})
+		if _, ok := message.MessageAttributes["x-pg-tenant"]; !ok {
+			record.Headers = append(record.Headers, kafka.Header{Key: "x-pg-tenant", Value: []byte(envelope.Tenant)})
+		}
+	}
+	if envelope.Baggage != "" {
+		record.Headers = append(record.Headers, kafka.Header{Key: "ce_baggage", Value: []byte(envelope.Baggage)})
+		if _, ok := message.MessageAttributes["baggage"]; !ok {
+			record.Headers = append(record.Headers, kafka.Header{Key: "baggage", Value: []byte(envelope.Baggage)})
+		}
+	}
+	return record
+}
+
+// forwardToKafka is the Reader's process func in sqs-to-kafka mode.
+func forwardToKafka(ctx context.Context, message types.Message) error {
+	return KafkaWriter.WriteMessages(ctx, SqsToKafka(message))
+}
+
+// KafkaToSqs
+// Translate a Kafka record into the SQS message ip-visit-counter would have
+// sent: binary-mode ce_ headers are folded into a structured-mode envelope,
+// and headers such as x-pg-tenant and baggage become message attributes.
+func KafkaToSqs(record kafka.Message, queueUrl string) *sqs.SendMessageInput {
+	headers := map[string]string{}
+	for _, header := range record.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+
+	body := string(record.Value)
+	attributes := map[string]types.MessageAttributeValue{}
+	if headers["ce_specversion"] != "" {
+		envelope := CloudEvent{
+			SpecVersion:     headers["ce_specversion"],
+			Id:              headers["ce_id"],
+			Source:          headers["ce_source"],
+			Type:            headers["ce_type"],
+			DataContentType: headers["content-type"],
+			Tenant:          headers["ce_tenant"],
+			Baggage:         headers["ce_baggage"],
+			Data:            record.Value,
+		}
+		envelope.Time, _ = time.Parse(time.RFC3339Nano, headers["ce_time"])
+		if encoded, err := json.Marshal(envelope); err == nil {
+			body = string(encoded)
+			attributes["content-type"] = stringAttribute(cloudEventsContentType)
+		}
+	}
+	// x-pg-tenant first: mirrord queue splitting filters on it, so it must
+	// never be the header that doesn't fit.
+	for _, key := range append([]string{"x-pg-tenant", "baggage"}, sortedKeys(headers)...) {
+		value, ok := headers[key]
+		if !ok || value == "" || strings.HasPrefix(key, "ce_") || key == "content-type" {
+			continue
+		}
+		if _, done := attributes[key]; done || len(attributes) == maxSqsAttributes {
+			continue
+		}
+		attributes[key] = stringAttribute(value)
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(queueUrl),
+		MessageBody:       aws.String(body),
+		MessageAttributes: attributes,
+	}
+	if isFifoQueue(queueUrl) {
+		// Same grouping as the counter: one group per visitor.
+		var visit IpMessage
+		_ = json.Unmarshal(record.Value, &visit)
+		group := visit.Ip
+		if group == "" {
+			group = "default"
+		}
+		dedup := visit.EventId
+		if headers["ce_id"] != "" {
+			dedup = headers["ce_id"]
+		}
+		if dedup == "" {
+			dedup = record.Topic + "-" + strconv.Itoa(record.Partition) + "-" + strconv.FormatInt(record.Offset, 10)
+		}
+		input.MessageGroupId = aws.String(group)
+		input.MessageDeduplicationId = aws.String(dedup)
+	}
+	return input
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// RunKafkaToSqs
+// Forward records from the topic to the queue until ctx is done. Offsets are
+// committed only after the message is on the queue, so a failed send is
+// retried rather than lost.
+func RunKafkaToSqs(ctx context.Context, address, topic, group string) error {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{address},
+		Topic:   topic,
+		GroupID: group,
+	})
+	defer reader.Close()
+
+	for {
+		record, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to fetch from kafka, %w", err)
+		}
+		health.Polled(kafkaConsumer)
+		input := KafkaToSqs(record, SqsQueueUrl)
+		for attempt := 1; ; attempt++ {
+			// Let a send that is under way finish during shutdown.
+			_, err = sqsClient.SendMessage(context.WithoutCancel(ctx), input)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+			wait := backoff(attempt, 500*time.Millisecond, 30*time.Second)
+			log.Printf("failed to forward record %d to sqs, retrying in %s: %v", record.Offset, wait, err)
+			sleep(ctx, wait)
+		}
+		if err != nil {
+			// Shutting down with the record unsent; it is fetched again next time.
+			return nil
+		}
+		if err := reader.CommitMessages(context.WithoutCancel(ctx), record); err != nil {
+			log.Printf("failed to commit offset %d: %v", record.Offset, err)
+		}
+	}
+}
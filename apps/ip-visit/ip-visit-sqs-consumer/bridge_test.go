@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/segmentio/kafka-go"
+)
+
+var bridgeTime = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+const bridgeVisit = `{"version":2,"event_id":"ev-1","ip":"203.0.113.7","tenant":"alice"}`
+
+// cloudEventBody is a structured-mode envelope around bridgeVisit.
+func cloudEventBody(t *testing.T, tenant, baggage string) string {
+	t.Helper()
+	body, err := json.Marshal(CloudEvent{
+		SpecVersion:     "1.0",
+		Id:              "ev-1",
+		Source:          "ip-visit-counter",
+		Type:            "com.metalbear.ipvisit.v2",
+		Time:            bridgeTime,
+		DataContentType: "application/json",
+		Tenant:          tenant,
+		Baggage:         baggage,
+		Data:            json.RawMessage(bridgeVisit),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func headerMap(headers []kafka.Header) map[string]string {
+	out := map[string]string{}
+	for _, header := range headers {
+		out[header.Key] = string(header.Value)
+	}
+	return out
+}
+
+func attributeMap(attributes map[string]types.MessageAttributeValue) map[string]string {
+	out := map[string]string{}
+	for key, value := range attributes {
+		out[key] = aws.ToString(value.StringValue)
+	}
+	return out
+}
+
+func TestSqsToKafka(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		attributes  map[string]types.MessageAttributeValue
+		wantValue   string
+		wantHeaders map[string]string
+	}{
+		{
+			name:       "legacy body passes through",
+			body:       bridgeVisit,
+			attributes: map[string]types.MessageAttributeValue{"x-pg-tenant": stringAttribute("alice")},
+			wantValue:  bridgeVisit,
+			wantHeaders: map[string]string{
+				"x-pg-tenant": "alice",
+			},
+		},
+		{
+			name: "undecodable body passes through",
+			body: "not json",
+			attributes: map[string]types.MessageAttributeValue{
+				"baggage":      stringAttribute("mirrord-session=alice"),
+				"content-type": stringAttribute(cloudEventsContentType),
+			},
+			wantValue:   "not json",
+			wantHeaders: map[string]string{"baggage": "mirrord-session=alice"},
+		},
+		{
+			name:       "cloudevent becomes binary mode",
+			body:       cloudEventBody(t, "alice", "mirrord-session=alice"),
+			attributes: map[string]types.MessageAttributeValue{"content-type": stringAttribute(cloudEventsContentType)},
+			wantValue:  bridgeVisit,
+			wantHeaders: map[string]string{
+				"ce_specversion": "1.0",
+				"ce_id":          "ev-1",
+				"ce_source":      "ip-visit-counter",
+				"ce_type":        "com.metalbear.ipvisit.v2",
+				"ce_time":        bridgeTime.Format(time.RFC3339Nano),
+				"content-type":   "application/json",
+				"ce_tenant":      "alice",
+				"x-pg-tenant":    "alice",
+				"ce_baggage":     "mirrord-session=alice",
+				"baggage":        "mirrord-session=alice",
+			},
+		},
+		{
+			name: "attributes win over envelope extensions",
+			body: cloudEventBody(t, "alice", "mirrord-session=alice"),
+			attributes: map[string]types.MessageAttributeValue{
+				"x-pg-tenant": stringAttribute("bob"),
+				"baggage":     stringAttribute("mirrord-session=bob"),
+			},
+			wantValue: bridgeVisit,
+			wantHeaders: map[string]string{
+				"ce_specversion": "1.0",
+				"ce_id":          "ev-1",
+				"ce_source":      "ip-visit-counter",
+				"ce_type":        "com.metalbear.ipvisit.v2",
+				"ce_time":        bridgeTime.Format(time.RFC3339Nano),
+				"content-type":   "application/json",
+				"ce_tenant":      "alice",
+				"x-pg-tenant":    "bob",
+				"ce_baggage":     "mirrord-session=alice",
+				"baggage":        "mirrord-session=bob",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := SqsToKafka(types.Message{Body: aws.String(tt.body), MessageAttributes: tt.attributes})
+			if string(record.Value) != tt.wantValue {
+				t.Errorf("value = %s, want %s", record.Value, tt.wantValue)
+			}
+			if got := headerMap(record.Headers); !maps.Equal(got, tt.wantHeaders) {
+				t.Errorf("headers = %v, want %v", got, tt.wantHeaders)
+			}
+			if len(record.Headers) != len(tt.wantHeaders) {
+				t.Errorf("got %d headers, want %d: a header is duplicated", len(record.Headers), len(tt.wantHeaders))
+			}
+		})
+	}
+}
+
+func TestKafkaToSqsLegacy(t *testing.T) {
+	record := kafka.Message{
+		Value: []byte(bridgeVisit),
+		Headers: []kafka.Header{
+			{Key: "x-pg-tenant", Value: []byte("alice")},
+			{Key: "traceparent", Value: []byte("00-abc-def-01")},
+			{Key: "empty", Value: nil},
+		},
+	}
+	input := KafkaToSqs(record, "https://sqs/IpCount")
+	if got := aws.ToString(input.MessageBody); got != bridgeVisit {
+		t.Errorf("body = %s, want %s", got, bridgeVisit)
+	}
+	want := map[string]string{"x-pg-tenant": "alice", "traceparent": "00-abc-def-01"}
+	if got := attributeMap(input.MessageAttributes); !maps.Equal(got, want) {
+		t.Errorf("attributes = %v, want %v", got, want)
+	}
+	if input.MessageGroupId != nil || input.MessageDeduplicationId != nil {
+		t.Errorf("standard queue got FIFO parameters")
+	}
+}
+
+func TestKafkaToSqsRoundTrip(t *testing.T) {
+	body := cloudEventBody(t, "alice", "mirrord-session=alice")
+	record := SqsToKafka(types.Message{
+		Body:              aws.String(body),
+		MessageAttributes: map[string]types.MessageAttributeValue{"content-type": stringAttribute(cloudEventsContentType)},
+	})
+	input := KafkaToSqs(record, "https://sqs/IpCount")
+
+	visit, envelope, err := DecodeVisit(types.Message{Body: input.MessageBody})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var original CloudEvent
+	if err := json.Unmarshal([]byte(body), &original); err != nil {
+		t.Fatal(err)
+	}
+	if envelope == nil {
+		t.Fatalf("body %s is not a CloudEvent", aws.ToString(input.MessageBody))
+	}
+	if envelope.Id != original.Id || envelope.Source != original.Source || envelope.Type != original.Type ||
+		!envelope.Time.Equal(original.Time) || envelope.Tenant != original.Tenant || envelope.Baggage != original.Baggage ||
+		envelope.DataContentType != original.DataContentType {
+		t.Errorf("envelope = %+v, want %+v", envelope, original)
+	}
+	if visit.EventId != "ev-1" || visit.Ip != "203.0.113.7" {
+		t.Errorf("visit = %+v", visit)
+	}
+	want := map[string]string{
+		"content-type": cloudEventsContentType,
+		"x-pg-tenant":  "alice",
+		"baggage":      "mirrord-session=alice",
+	}
+	if got := attributeMap(input.MessageAttributes); !maps.Equal(got, want) {
+		t.Errorf("attributes = %v, want %v", got, want)
+	}
+}
+
+func TestKafkaToSqsAttributeLimit(t *testing.T) {
+	// More headers than SQS takes; the ones sorting first would crowd out
+	// x-pg-tenant if it weren't kept first.
+	var headers []kafka.Header
+	for i := range maxSqsAttributes + 5 {
+		headers = append(headers, kafka.Header{Key: "a-" + strconv.Itoa(i), Value: []byte("x")})
+	}
+	headers = append(headers, kafka.Header{Key: "x-pg-tenant", Value: []byte("alice")})
+	input := KafkaToSqs(kafka.Message{Value: []byte(bridgeVisit), Headers: headers}, "https://sqs/IpCount")
+
+	if len(input.MessageAttributes) != maxSqsAttributes {
+		t.Errorf("got %d attributes, want %d", len(input.MessageAttributes), maxSqsAttributes)
+	}
+	if got := aws.ToString(input.MessageAttributes["x-pg-tenant"].StringValue); got != "alice" {
+		t.Errorf("x-pg-tenant = %q, want alice", got)
+	}
+}
+
+func TestKafkaToSqsFifo(t *testing.T) {
+	const queueUrl = "https://sqs/IpCount.fifo"
+	tests := []struct {
+		name      string
+		record    kafka.Message
+		wantGroup string
+		wantDedup string
+	}{
+		{
+			name:      "visitor group and event id",
+			record:    kafka.Message{Value: []byte(bridgeVisit)},
+			wantGroup: "203.0.113.7",
+			wantDedup: "ev-1",
+		},
+		{
+			name: "cloudevent id",
+			record: kafka.Message{
+				Value:   []byte(bridgeVisit),
+				Headers: []kafka.Header{{Key: "ce_specversion", Value: []byte("1.0")}, {Key: "ce_id", Value: []byte("ce-9")}},
+			},
+			wantGroup: "203.0.113.7",
+			wantDedup: "ce-9",
+		},
+		{
+			name:      "record position without an id",
+			record:    kafka.Message{Topic: "visits", Partition: 2, Offset: 41, Value: []byte("{}")},
+			wantGroup: "default",
+			wantDedup: "visits-2-41",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := KafkaToSqs(tt.record, queueUrl)
+			if got := aws.ToString(input.MessageGroupId); got != tt.wantGroup {
+				t.Errorf("MessageGroupId = %q, want %q", got, tt.wantGroup)
+			}
+			if got := aws.ToString(input.MessageDeduplicationId); got != tt.wantDedup {
+				t.Errorf("MessageDeduplicationId = %q, want %q", got, tt.wantDedup)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/gin-gonic/gin"
+)
+
+// Why a message was dead-lettered, in its x-dlq-reason attribute.
+const (
+	DlqReasonUndecodable = "undecodable"
+	DlqReasonMaxReceives = "max-receives"
+)
+
+// Attributes added to dead-lettered messages. Redrive strips them again.
+const (
+	dlqAttributePrefix   = "x-dlq-"
+	dlqReasonAttribute   = "x-dlq-reason"
+	dlqErrorAttribute    = "x-dlq-error"
+	dlqReceiveAttribute  = "x-dlq-receive-count"
+	maxDlqErrorLength    = 512
+	maxRedriveMessages   = 1000
+	redriveVisibilitySec = 30
+)
+
+var DlqUrl = ""
+
+// receiveCount is the message's ApproximateReceiveCount, 1 when SQS didn't send it.
+func receiveCount(message types.Message) int {
+	count, err := strconv.Atoi(message.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+	if err != nil || count < 1 {
+		return 1
+	}
+	return count
+}
+
+// deadLetter copies message to the DLQ with why it failed, then deletes it.
+// If the copy fails the message stays on the queue to be retried, and
+// deadLetter returns false.
+func (r *Reader) deadLetter(message types.Message, reason string, cause error) bool {
+	attributes := make(map[string]types.MessageAttributeValue, len(message.MessageAttributes)+3)
+	for key, value := range message.MessageAttributes {
+		attributes[key] = value
+	}
+	errorText := cause.Error()
+	if len(errorText) > maxDlqErrorLength {
+		errorText = errorText[:maxDlqErrorLength]
+	}
+	attributes[dlqReasonAttribute] = stringAttribute(reason)
+	attributes[dlqErrorAttribute] = stringAttribute(errorText)
+	attributes[dlqReceiveAttribute] = types.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(receiveCount(message))),
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(r.config.DlqUrl),
+		MessageBody:       message.Body,
+		MessageAttributes: attributes,
+	}
+	// A FIFO queue's DLQ must be FIFO too; keep the message in its group.
+	setFifoParameters(input, message)
+	if _, err := r.client.SendMessage(context.Background(), input); err != nil {
+		log.Printf("failed to dead-letter message %s: %v", *message.MessageId, err)
+		return false
+	}
+	log.Printf("dead-lettered message %s (%s): %v", *message.MessageId, reason, cause)
+	r.deletes <- *message.ReceiptHandle
+	return true
+}
+
+func stringAttribute(value string) types.MessageAttributeValue {
+	return types.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(value),
+	}
+}
+
+// DlqMessage
+// A dead-lettered message as listed by GET /dlq
+type DlqMessage struct {
+	MessageId    string            `json:"message_id"`
+	Body         string            `json:"body"`
+	Attributes   map[string]string `json:"attributes"`
+	Reason       string            `json:"reason"`
+	Error        string            `json:"error"`
+	ReceiveCount int               `json:"receive_count"`
+	SentAt       time.Time         `json:"sent_at"`
+}
+
+func newDlqMessage(message types.Message) DlqMessage {
+	attributes := map[string]string{}
+	for key, value := range message.MessageAttributes {
+		attributes[key] = aws.ToString(value.StringValue)
+	}
+	receives, _ := strconv.Atoi(attributes[dlqReceiveAttribute])
+	sentMs, _ := strconv.ParseInt(message.Attributes[string(types.MessageSystemAttributeNameSentTimestamp)], 10, 64)
+	return DlqMessage{
+		MessageId:    aws.ToString(message.MessageId),
+		Body:         aws.ToString(message.Body),
+		Attributes:   attributes,
+		Reason:       attributes[dlqReasonAttribute],
+		Error:        attributes[dlqErrorAttribute],
+		ReceiveCount: receives,
+		SentAt:       time.UnixMilli(sentMs).UTC(),
+	}
+}
+
+func receiveDlq(c context.Context, max int32, visibility int32) ([]types.Message, error) {
+	result, err := sqsClient.ReceiveMessage(c, &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(DlqUrl),
+		MaxNumberOfMessages:   max,
+		VisibilityTimeout:     visibility,
+		MessageAttributeNames: []string{"All"},
+		MessageSystemAttributeNames: []types.MessageSystemAttributeName{
+			types.MessageSystemAttributeNameSentTimestamp,
+			types.MessageSystemAttributeNameMessageGroupId,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Messages, nil
+}
+
+// listDlq serves GET /dlq. It peeks at up to 10 dead-lettered messages
+// without hiding them; SQS samples its servers, so repeated calls may show
+// different messages.
+func listDlq(c *gin.Context) {
+	if DlqUrl == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No dead-letter queue configured"})
+		return
+	}
+	messages, err := receiveDlq(c, maxSqsBatch, 0)
+	if err != nil {
+		log.Printf("failed to read dead-letter queue: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	listed := make([]DlqMessage, 0, len(messages))
+	for _, message := range messages {
+		listed = append(listed, newDlqMessage(message))
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": listed})
+}
+
+// redriveDlq serves POST /dlq/redrive. It moves dead-lettered messages back
+// to the queue without their x-dlq- attributes: all of them, up to ?max=, or
+// only those whose IDs are in the optional JSON body {"message_ids": [...]}.
+func redriveDlq(c *gin.Context) {
+	if DlqUrl == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No dead-letter queue configured"})
+		return
+	}
+	max, err := strconv.Atoi(c.DefaultQuery("max", strconv.Itoa(maxRedriveMessages)))
+	if err != nil || max < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max must be a positive number"})
+		return
+	}
+	var request struct {
+		MessageIds []string `json:"message_ids"`
+	}
+	// No body means every message; a body that doesn't parse must not.
+	if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body, expected {\"message_ids\": [...]}"})
+		return
+	}
+
+	redriven := []string{}
+	failed := 0
+	seen := map[string]bool{}
+	for len(redriven) < max {
+		messages, err := receiveDlq(c, int32(min(maxSqsBatch, max-len(redriven))), redriveVisibilitySec)
+		if err != nil {
+			log.Printf("failed to read dead-letter queue: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error", "redriven": redriven})
+			return
+		}
+		if len(messages) == 0 {
+			break
+		}
+		progress := false
+		for _, message := range messages {
+			if !seen[aws.ToString(message.MessageId)] {
+				seen[aws.ToString(message.MessageId)] = true
+				progress = true
+			}
+			if len(request.MessageIds) > 0 && !slices.Contains(request.MessageIds, aws.ToString(message.MessageId)) {
+				// Not asked for; make it visible again right away.
+				sqsClient.ChangeMessageVisibility(c, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(DlqUrl),
+					ReceiptHandle:     message.ReceiptHandle,
+					VisibilityTimeout: 0,
+				})
+				continue
+			}
+			if err := redrive(c, message); err != nil {
+				log.Printf("failed to redrive message %s: %v", aws.ToString(message.MessageId), err)
+				failed++
+				continue
+			}
+			redriven = append(redriven, aws.ToString(message.MessageId))
+		}
+		// Skipped messages come straight back; stop once a poll finds nothing new.
+		if !progress || len(request.MessageIds) > 0 && len(redriven)+failed >= len(request.MessageIds) {
+			break
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"redriven": redriven, "failed": failed})
+}
+
+func redrive(c context.Context, message types.Message) error {
+	attributes := map[string]types.MessageAttributeValue{}
+	for key, value := range message.MessageAttributes {
+		if !strings.HasPrefix(key, dlqAttributePrefix) {
+			attributes[key] = value
+		}
+	}
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(SqsQueueUrl),
+		MessageBody:       message.Body,
+		MessageAttributes: attributes,
+	}
+	setFifoParameters(input, message)
+	_, err := sqsClient.SendMessage(c, input)
+	if err != nil {
+		return err
+	}
+	result, err := sqsClient.DeleteMessageBatch(c, &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(DlqUrl),
+		Entries: []types.DeleteMessageBatchRequestEntry{
+			{Id: aws.String("0"), ReceiptHandle: message.ReceiptHandle},
+		},
+	})
+	if err == nil && len(result.Failed) > 0 {
+		// Already sent back; it will be redriven twice, which stats dedup absorbs.
+		err = fmt.Errorf("sent back but not deleted: %s", aws.ToString(result.Failed[0].Message))
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/gin-gonic/gin"
+)
+
+// setupDlq points the DLQ handlers at a fakeQueue holding one dead letter.
+// The queue also stands in for the main queue, so a redrive sends the message
+// back to it.
+func setupDlq(t *testing.T) *fakeQueue {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	savedClient, savedDlq, savedQueue := sqsClient, DlqUrl, SqsQueueUrl
+	t.Cleanup(func() { sqsClient, DlqUrl, SqsQueueUrl = savedClient, savedDlq, savedQueue })
+
+	queue := newFakeQueue(0)
+	queue.SendMessage(context.Background(), &sqs.SendMessageInput{MessageBody: aws.String(`{"ip":"203.0.113.0"}`)})
+	sqsClient, DlqUrl, SqsQueueUrl = queue, "dlq", "queue"
+	return queue
+}
+
+func TestRedriveDlqBody(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantStatus   int
+		wantRedriven int
+	}{
+		{name: "no body redrives everything", body: "", wantStatus: http.StatusOK, wantRedriven: 1},
+		{name: "unknown ids", body: `{"message_ids": ["nope"]}`, wantStatus: http.StatusOK, wantRedriven: 0},
+		{name: "malformed json", body: `{"message_ids": [`, wantStatus: http.StatusBadRequest},
+		{name: "wrong type", body: `{"message_ids": "1"}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := setupDlq(t)
+			router := gin.New()
+			router.POST("/dlq/redrive", redriveDlq)
+
+			// max=1: the fake queue is also the main queue, so redriven
+			// messages would come back forever.
+			req := httptest.NewRequest(http.MethodPost, "/dlq/redrive?max=1", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("POST /dlq/redrive = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if queue.Len() != 1 || queue.nextId != 1 {
+					t.Errorf("a rejected request touched the queue")
+				}
+				return
+			}
+			var response struct {
+				Redriven []string `json:"redriven"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Redriven) != tt.wantRedriven {
+				t.Errorf("redriven %v, want %d", response.Redriven, tt.wantRedriven)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"time"
+
+	pb "github.com/metalbear-co/playground/protogen"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+const enrichTimeout = 2 * time.Second
+
+var ipInfoClient pb.IpInfoServiceClient
+
+type IpInfo struct {
+	Ip   string   `json:"ip"`
+	Info string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// SetupIpInfo
+// Initialize the ip-info-grpc client used to enrich visits
+func SetupIpInfo(address string) error {
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	ipInfoClient = pb.NewIpInfoServiceClient(conn)
+	return nil
+}
+
+// Enrich
+// Look the visit's IP up in ip-info-grpc into Info2 when the counter published
+// no enrichment. It is a no-op when IPINFOGRPCADDRESS is not set, and for IPs
+// the counter anonymized into hashes, which ip-info can't know.
+func Enrich(ctx context.Context, visit *IpMessage) error {
+	if ipInfoClient == nil || visit.Info != nil || visit.Info2 != nil {
+		return nil
+	}
+	if _, err := netip.ParseAddr(visit.Ip); err != nil {
+		return nil
+	}
+	md := metadata.New(map[string]string{})
+	if visit.Tenant != "" {
+		md.Append("x-pg-tenant", visit.Tenant)
+	}
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, md), enrichTimeout)
+	defer cancel()
+
+	res, err := ipInfoClient.GetIpInfo(ctx, &pb.IpRequest{Ip: visit.Ip})
+	if err != nil {
+		return err
+	}
+	tags := slices.Clone(res.Tags)
+	slices.Sort(tags)
+	visit.Info2 = &IpInfo{Ip: res.Ip, Info: res.Info, Tags: slices.Compact(tags)}
+	return nil
+}
+
+// infoTags returns the tags of both enrichments, without duplicates.
+func infoTags(visit *IpMessage) []string {
+	var tags []string
+	for _, info := range []*IpInfo{visit.Info, visit.Info2} {
+		if info != nil {
+			tags = append(tags, info.Tags...)
+		}
+	}
+	slices.Sort(tags)
+	return slices.Compact(tags)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// CloudEvent
+// Structured-mode CloudEvents envelope, as published by ip-visit-counter with
+// EVENTFORMAT=cloudevents. Tenant and Baggage are extension attributes.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Id              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Tenant          string          `json:"tenant,omitempty"`
+	Baggage         string          `json:"baggage,omitempty"`
+	Data            json.RawMessage `json:"data"`
+}
+
+var errEmptyBody = errors.New("message has no body")
+
+// DecodeVisit
+// Decode an SQS message body as either a CloudEvents envelope or a legacy bare
+// IpMessage. The envelope is nil for legacy messages.
+func DecodeVisit(message types.Message) (*IpMessage, *CloudEvent, error) {
+	if message.Body == nil {
+		return nil, nil, errEmptyBody
+	}
+	body := []byte(*message.Body)
+
+	var envelope CloudEvent
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, nil, err
+	}
+	if envelope.SpecVersion == "" {
+		// Legacy: the body is the IpMessage itself.
+		visit := &IpMessage{}
+		if err := json.Unmarshal(body, visit); err != nil {
+			return nil, nil, err
+		}
+		return visit, nil, nil
+	}
+
+	visit := &IpMessage{}
+	if err := json.Unmarshal(envelope.Data, visit); err != nil {
+		return nil, nil, err
+	}
+	if visit.Tenant == "" {
+		visit.Tenant = envelope.Tenant
+	}
+	return visit, &envelope, nil
+}
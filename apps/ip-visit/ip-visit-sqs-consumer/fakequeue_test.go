@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// fakeQueue is an in-memory stand-in for one standard SQS queue: visibility
+// timeouts, receive counts and long polling, with an optional latency added to
+// every call. It implements SqsApi for the tests and benchmarks.
+type fakeQueue struct {
+	latency time.Duration
+
+	mu       sync.Mutex
+	messages []*fakeMessage
+	receipts map[string]*fakeMessage
+	nextId   int
+}
+
+type fakeMessage struct {
+	id           string
+	body         string
+	attributes   map[string]types.MessageAttributeValue
+	visibleAt    time.Time
+	receiveCount int
+	receipt      string
+}
+
+func newFakeQueue(latency time.Duration) *fakeQueue {
+	return &fakeQueue{latency: latency, receipts: map[string]*fakeMessage{}}
+}
+
+// Len returns how many messages are still on the queue, visible or not.
+func (q *fakeQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+func (q *fakeQueue) call(ctx context.Context) error {
+	if q.latency == 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(q.latency):
+		return nil
+	}
+}
+
+func (q *fakeQueue) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	if err := q.call(ctx); err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.nextId++
+	message := &fakeMessage{
+		id:         strconv.Itoa(q.nextId),
+		body:       aws.ToString(params.MessageBody),
+		attributes: params.MessageAttributes,
+		visibleAt:  time.Now().Add(time.Duration(params.DelaySeconds) * time.Second),
+	}
+	q.messages = append(q.messages, message)
+	return &sqs.SendMessageOutput{MessageId: aws.String(message.id)}, nil
+}
+
+func (q *fakeQueue) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	if err := q.call(ctx); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(time.Duration(params.WaitTimeSeconds) * time.Second)
+	for {
+		if received := q.receive(params); len(received) > 0 || !time.Now().Before(deadline) {
+			return &sqs.ReceiveMessageOutput{Messages: received}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func (q *fakeQueue) receive(params *sqs.ReceiveMessageInput) []types.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	max := max(int(params.MaxNumberOfMessages), 1)
+	visibility := time.Duration(params.VisibilityTimeout) * time.Second
+	if visibility == 0 {
+		visibility = 30 * time.Second
+	}
+	now := time.Now()
+	received := []types.Message{}
+	for _, message := range q.messages {
+		if len(received) == max {
+			break
+		}
+		if message.visibleAt.After(now) {
+			continue
+		}
+		delete(q.receipts, message.receipt)
+		message.receiveCount++
+		message.receipt = message.id + "-" + strconv.Itoa(message.receiveCount)
+		message.visibleAt = now.Add(visibility)
+		q.receipts[message.receipt] = message
+		received = append(received, types.Message{
+			MessageId:         aws.String(message.id),
+			ReceiptHandle:     aws.String(message.receipt),
+			Body:              aws.String(message.body),
+			MessageAttributes: message.attributes,
+			Attributes: map[string]string{
+				string(types.MessageSystemAttributeNameApproximateReceiveCount): strconv.Itoa(message.receiveCount),
+			},
+		})
+	}
+	return received
+}
+
+func (q *fakeQueue) DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	if err := q.call(ctx); err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	output := &sqs.DeleteMessageBatchOutput{}
+	deleted := map[*fakeMessage]bool{}
+	for _, entry := range params.Entries {
+		message, ok := q.receipts[aws.ToString(entry.ReceiptHandle)]
+		if !ok {
+			output.Failed = append(output.Failed, types.BatchResultErrorEntry{
+				Id:          entry.Id,
+				Code:        aws.String("ReceiptHandleIsInvalid"),
+				Message:     aws.String("unknown receipt handle"),
+				SenderFault: true,
+			})
+			continue
+		}
+		delete(q.receipts, message.receipt)
+		deleted[message] = true
+		output.Successful = append(output.Successful, types.DeleteMessageBatchResultEntry{Id: entry.Id})
+	}
+	remaining := q.messages[:0]
+	for _, message := range q.messages {
+		if !deleted[message] {
+			remaining = append(remaining, message)
+		}
+	}
+	q.messages = remaining
+	return output, nil
+}
+
+func (q *fakeQueue) GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	if err := q.call(ctx); err != nil {
+		return nil, err
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]string{}}, nil
+}
+
+func (q *fakeQueue) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if err := q.call(ctx); err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	message, ok := q.receipts[aws.ToString(params.ReceiptHandle)]
+	if !ok {
+		return nil, &types.ReceiptHandleIsInvalid{Message: aws.String("unknown receipt handle")}
+	}
+	message.visibleAt = time.Now().Add(time.Duration(params.VisibilityTimeout) * time.Second)
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
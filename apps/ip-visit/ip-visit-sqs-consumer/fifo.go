@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// FIFO queues: ip-visit-counter sends each visitor's events in one message
+// group. SQS doesn't hand out a group's next message while one is in flight,
+// but a single batch may hold several messages of a group, so the reader
+// processes each group of a batch in order, and different groups in parallel.
+
+func isFifoQueue(queueUrl string) bool {
+	return strings.HasSuffix(queueUrl, ".fifo")
+}
+
+func messageGroupId(message types.Message) string {
+	return message.Attributes[string(types.MessageSystemAttributeNameMessageGroupId)]
+}
+
+// groupMessages splits a batch by message group, keeping the order within
+// each group.
+func groupMessages(messages []types.Message) [][]types.Message {
+	index := map[string]int{}
+	groups := [][]types.Message{}
+	for _, message := range messages {
+		id := messageGroupId(message)
+		i, ok := index[id]
+		if !ok {
+			i = len(groups)
+			index[id] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], message)
+	}
+	return groups
+}
+
+// handleGroup processes one group's messages in order, each holding a worker
+// slot until it is done. When a message is left on the queue, the rest of the
+// group is released unprocessed so nothing overtakes it.
+func (r *Reader) handleGroup(ctx context.Context, group []types.Message) {
+	defer r.workers.Done()
+
+	// Later messages wait for earlier ones; keep all of them hidden meanwhile.
+	stops := make([]func(), len(group))
+	for i, message := range group {
+		stops[i] = r.heartbeat(message)
+	}
+	for i, message := range group {
+		ok := r.handle(ctx, message, stops[i])
+		stops[i]()
+		r.release(1)
+		if ok {
+			continue
+		}
+		for j, rest := range group[i+1:] {
+			stops[i+1+j]()
+			r.release(1)
+			r.requeue(rest)
+		}
+		return
+	}
+}
+
+// setFifoParameters keeps a copied message in its group when it is sent to
+// a FIFO queue, deduplicated by the ID of the message it was copied from.
+func setFifoParameters(input *sqs.SendMessageInput, from types.Message) {
+	if !isFifoQueue(aws.ToString(input.QueueUrl)) {
+		return
+	}
+	group := messageGroupId(from)
+	if group == "" {
+		group = "default"
+	}
+	input.MessageGroupId = aws.String(group)
+	input.MessageDeduplicationId = from.MessageId
+}
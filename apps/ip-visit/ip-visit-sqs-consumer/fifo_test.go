@@ -0,0 +1,148 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// groupedMessage is a received message with its ID and message group.
+func groupedMessage(id, group string) types.Message {
+	message := types.Message{MessageId: aws.String(id), Attributes: map[string]string{}}
+	if group != "" {
+		message.Attributes[string(types.MessageSystemAttributeNameMessageGroupId)] = group
+	}
+	return message
+}
+
+func TestIsFifoQueue(t *testing.T) {
+	tests := []struct {
+		queueUrl string
+		want     bool
+	}{
+		{"https://sqs.eu-north-1.amazonaws.com/123456789012/IpCount.fifo", true},
+		{"https://sqs.eu-north-1.amazonaws.com/123456789012/IpCount", false},
+		{"https://sqs.eu-north-1.amazonaws.com/123456789012/fifo", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isFifoQueue(tt.queueUrl); got != tt.want {
+			t.Errorf("isFifoQueue(%q) = %v, want %v", tt.queueUrl, got, tt.want)
+		}
+	}
+}
+
+func TestGroupMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []types.Message
+		want     [][]string // message IDs per group
+	}{
+		{name: "empty", want: [][]string{}},
+		{
+			name:     "standard queue is one group",
+			messages: []types.Message{groupedMessage("1", ""), groupedMessage("2", "")},
+			want:     [][]string{{"1", "2"}},
+		},
+		{
+			name: "groups in order of first message",
+			messages: []types.Message{
+				groupedMessage("1", "b"),
+				groupedMessage("2", "a"),
+				groupedMessage("3", "b"),
+				groupedMessage("4", "c"),
+				groupedMessage("5", "a"),
+			},
+			want: [][]string{{"1", "3"}, {"2", "5"}, {"4"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups := groupMessages(tt.messages)
+			got := [][]string{}
+			for _, group := range groups {
+				var ids []string
+				for _, message := range group {
+					ids = append(ids, aws.ToString(message.MessageId))
+				}
+				got = append(got, ids)
+			}
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("groupMessages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetFifoParameters(t *testing.T) {
+	tests := []struct {
+		name      string
+		queueUrl  string
+		from      types.Message
+		wantGroup string // "" when unset
+		wantDedup string
+	}{
+		{name: "standard queue", queueUrl: "https://sqs/IpCount", from: groupedMessage("m1", "visitor-1")},
+		{name: "keeps the group", queueUrl: "https://sqs/IpCount.fifo", from: groupedMessage("m1", "visitor-1"), wantGroup: "visitor-1", wantDedup: "m1"},
+		{name: "default group", queueUrl: "https://sqs/IpCount.fifo", from: groupedMessage("m2", ""), wantGroup: "default", wantDedup: "m2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := &sqs.SendMessageInput{QueueUrl: aws.String(tt.queueUrl)}
+			setFifoParameters(input, tt.from)
+			if got := aws.ToString(input.MessageGroupId); got != tt.wantGroup {
+				t.Errorf("MessageGroupId = %q, want %q", got, tt.wantGroup)
+			}
+			if got := aws.ToString(input.MessageDeduplicationId); got != tt.wantDedup {
+				t.Errorf("MessageDeduplicationId = %q, want %q", got, tt.wantDedup)
+			}
+		})
+	}
+}
+
+func TestFilterReleasesFifoGroups(t *testing.T) {
+	tenantMessage := func(id, group, tenant string) types.Message {
+		message := groupedMessage(id, group)
+		message.ReceiptHandle = aws.String(id)
+		message.MessageAttributes = map[string]types.MessageAttributeValue{
+			"x-pg-tenant": {DataType: aws.String("String"), StringValue: aws.String(tenant)},
+		}
+		return message
+	}
+	messages := []types.Message{
+		tenantMessage("1", "a", "alice"),
+		tenantMessage("2", "b", "alice"),
+		tenantMessage("3", "a", "bob"),
+		tenantMessage("4", "c", "bob"),
+		tenantMessage("5", "b", "alice"),
+	}
+
+	for _, fifo := range []bool{false, true} {
+		r := &Reader{
+			client:       newFakeQueue(0),
+			queueUrl:     "queue",
+			fifo:         fifo,
+			tenantFilter: regexp.MustCompile("^alice$"),
+			slots:        make(chan struct{}, len(messages)),
+		}
+		var got []string
+		for _, message := range r.filter(messages) {
+			got = append(got, aws.ToString(message.MessageId))
+		}
+		// Group a's 3 isn't alice's, so on a FIFO queue 1 must wait for it.
+		want := []string{"1", "2", "5"}
+		if fifo {
+			want = []string{"2", "5"}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("fifo=%v: filter() kept %v, want %v", fifo, got, want)
+		}
+		if released := len(r.slots); released != len(messages)-len(want) {
+			t.Errorf("fifo=%v: released %d slots, want %d", fifo, released, len(messages)-len(want))
+		}
+	}
+}
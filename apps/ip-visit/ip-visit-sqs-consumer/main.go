@@ -2,40 +2,83 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/gin-gonic/gin"
+	"github.com/metalbear-co/playground/internal/health"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/segmentio/kafka-go"
 	"github.com/spf13/viper"
 )
 
 var ctx = context.Background()
 var SqsQueueUrl = ""
-var sqsClient *sqs.Client
+var sqsClient SqsApi
+
+// logVisits prints every processed visit; the benchmarks turn it off.
+var logVisits = true
 
 type Config struct {
-	Port         int16
-	SqsQueueName string
+	Port int16
+	// Mode is consume (default), sqs-to-kafka or kafka-to-sqs.
+	Mode               string
+	SqsQueueName       string
+	SqsDlqName         string
+	KafkaAddress       string
+	KafkaTopic         string
+	KafkaConsumerGroup string
+	// IpInfoGrpcAddress enables enrichment through ip-info-grpc when set.
+	IpInfoGrpcAddress string
+	StatsStore        string // memory (default) or redis
+	RedisAddress      string
+	Reader            ReaderConfig
+	// MessageLogSize is how many settled messages GET /messages keeps.
+	MessageLogSize int
+	// ShutdownTimeout bounds how long in-flight messages and requests get on SIGTERM.
+	ShutdownTimeout time.Duration
 }
 
+// IpMessage
+// Visit event published by ip-visit-counter. Version 1 only had Ip; the rest
+// is additive and zero for older events.
 type IpMessage struct {
-	Ip string `json:"ip"`
+	Version   int       `json:"version"`
+	EventId   string    `json:"event_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Ip        string    `json:"ip"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Info      *IpInfo   `json:"info,omitempty"`
+	Info2     *IpInfo   `json:"info2,omitempty"`
+	Decision  string    `json:"decision,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
 }
 
 // SetupSqs
-// Initialize SQS client
-func SetupSqs(queue_name string) error {
+// Initialize SQS client, and resolve the dead-letter queue when one is configured
+func SetupSqs(queue_name, dlq_name string) error {
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		log.Fatalf("unable to load SDK config, %v", err)
 	}
 
-	sqsClient = sqs.NewFromConfig(cfg)
-	res, err := sqsClient.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+	client := sqs.NewFromConfig(cfg)
+	sqsClient = client
+	res, err := client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
 		QueueName: aws.String(queue_name),
 	})
 	if err != nil {
@@ -43,6 +86,16 @@ func SetupSqs(queue_name string) error {
 		return err
 	}
 	SqsQueueUrl = *res.QueueUrl
+
+	if dlq_name != "" {
+		res, err := client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+			QueueName: aws.String(dlq_name),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to get dead-letter queue URL, %w", err)
+		}
+		DlqUrl = *res.QueueUrl
+	}
 	return nil
 }
 
@@ -51,82 +104,228 @@ func loadConfig() Config {
 	viper.BindEnv("kafkaaddress")
 	viper.BindEnv("kafkatopic")
 	viper.BindEnv("kafkaconsumergroup")
+	viper.BindEnv("mode")
+	viper.BindEnv("tenantfilter")
+	viper.BindEnv("messagelogsize")
+	viper.SetDefault("messagelogsize", 100)
+	viper.BindEnv("redactattributes")
+	viper.SetDefault("mode", ModeConsume)
 	viper.BindEnv("sqsqueuename")
+	viper.BindEnv("ipinfogrpcaddress")
+	viper.BindEnv("statsstore")
+	viper.BindEnv("redisaddress")
+	viper.BindEnv("sqsconcurrency")
+	viper.BindEnv("sqsbatchsize")
+	viper.BindEnv("sqswaittime")
+	viper.BindEnv("sqsvisibilitytimeout")
+	viper.BindEnv("sqsdlqname")
+	viper.BindEnv("sqsmaxreceivecount")
+	viper.SetDefault("sqsmaxreceivecount", 5)
+	viper.BindEnv("shutdowntimeout")
+	viper.SetDefault("shutdowntimeout", "20s")
+	viper.SetDefault("sqsconcurrency", 10)
+	viper.SetDefault("sqsbatchsize", 10)
+	viper.SetDefault("sqswaittime", "10s")
+	viper.SetDefault("sqsvisibilitytimeout", "30s")
 
 	config := Config{}
 	config.Port = int16(viper.GetInt("port"))
 	config.SqsQueueName = viper.GetString("SqsQueueName")
+	config.SqsDlqName = viper.GetString("sqsdlqname")
+	config.Mode = viper.GetString("mode")
+	config.KafkaAddress = viper.GetString("kafkaaddress")
+	config.KafkaTopic = viper.GetString("kafkatopic")
+	config.KafkaConsumerGroup = viper.GetString("kafkaconsumergroup")
+	config.ShutdownTimeout = viper.GetDuration("shutdowntimeout")
+	config.IpInfoGrpcAddress = viper.GetString("ipinfogrpcaddress")
+	config.StatsStore = viper.GetString("statsstore")
+	config.RedisAddress = viper.GetString("redisaddress")
+	config.Reader = ReaderConfig{
+		Concurrency:       viper.GetInt("sqsconcurrency"),
+		BatchSize:         viper.GetInt("sqsbatchsize"),
+		WaitTime:          viper.GetDuration("sqswaittime"),
+		VisibilityTimeout: viper.GetDuration("sqsvisibilitytimeout"),
+		MaxReceiveCount:   viper.GetInt("sqsmaxreceivecount"),
+		TenantFilter:      viper.GetString("tenantfilter"),
+	}
+	config.MessageLogSize = viper.GetInt("messagelogsize")
+	for _, name := range strings.Split(viper.GetString("redactattributes"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			redactedAttributes = append(redactedAttributes, strings.ToLower(name))
+		}
+	}
 
 	return config
 }
 
-func DeleteMessage(receiptHandle string) {
-	// Create an input to delete the message
-	deleteMessageInput := &sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(SqsQueueUrl),
-		ReceiptHandle: aws.String(receiptHandle),
-	}
+var errUndecodable = errors.New("undecodable visit")
 
-	// Call SQS to delete the message
-	_, err := sqsClient.DeleteMessage(ctx, deleteMessageInput)
+// processMessage decodes a visit, enriches it through ip-info-grpc and adds it
+// to its tenant's stats.
+func processMessage(ctx context.Context, message types.Message) error {
+	visit, envelope, err := DecodeVisit(message)
 	if err != nil {
-		log.Fatalf("failed to delete message, %v", err)
+		return fmt.Errorf("%w: %v", errUndecodable, err)
+	}
+	// Legacy messages only carry the tenant as an attribute.
+	if attr, ok := message.MessageAttributes["x-pg-tenant"]; ok && visit.Tenant == "" && attr.StringValue != nil {
+		visit.Tenant = *attr.StringValue
+	}
+	if err := Enrich(ctx, visit); err != nil {
+		log.Printf("failed to enrich visit from %s: %v", visit.Ip, err)
+	}
+	if err := Stats.Record(ctx, visit); err != nil {
+		return err
 	}
 
-	fmt.Println("Message deleted successfully")
+	format := "legacy"
+	if envelope != nil {
+		format = "cloudevents"
+	}
+	if !logVisits {
+		return nil
+	}
+	fmt.Printf("Visit: id=%s format=%s tenant=%q ip=%s path=%s\n", *message.MessageId, format, visit.Tenant, visit.Ip, visit.Path)
+	return nil
 }
 
-func StartSqsReader() {
-	// A signal handler or similar could be used to set this to false to break the loop.
-	run := true
-
-	for run {
-		// Receive a message from the SQS queue
-		receiveMessageInput := &sqs.ReceiveMessageInput{
-			QueueUrl:            aws.String(SqsQueueUrl),
-			MaxNumberOfMessages: 1,  // Number of messages to receive (up to 10)
-			WaitTimeSeconds:     10, // Long polling (wait up to 10 seconds)
-			MessageAttributeNames: []string{
-				"All", // Retrieves all message attributes
-			},
-		}
-
-		// Call the SQS ReceiveMessage API
-		result, err := sqsClient.ReceiveMessage(ctx, receiveMessageInput)
-		if err != nil {
-			log.Fatalf("failed to receive messages, %v", err)
-		}
-
-		for _, message := range result.Messages {
-			fmt.Printf("Message ID: %s\n", *message.MessageId)
-			fmt.Printf("Message Body: %s\n", *message.Body)
+// Consumers reported by /health.Readyz.
+const (
+	sqsConsumer   = "sqs"
+	kafkaConsumer = "kafka"
+)
 
-			// Print message attributes if present
-			if len(message.MessageAttributes) > 0 {
-				for key, attr := range message.MessageAttributes {
-					fmt.Printf("Attribute: %s, Value: %s\n", key, *attr.StringValue)
-				}
+// setupHealthChecks
+// Register a readiness check for the queues, brokers and store the consumer
+// moves messages between. ip-info-grpc is left out: enrichment is best
+// effort, and a visit it fails for is recorded without it.
+func setupHealthChecks(config Config) {
+	health.AddCheck("sqs", func(ctx context.Context) error {
+		_, err := sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{QueueUrl: aws.String(SqsQueueUrl)})
+		return err
+	})
+	if DlqUrl != "" {
+		health.AddCheck("sqs-dlq", func(ctx context.Context) error {
+			_, err := sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{QueueUrl: aws.String(DlqUrl)})
+			return err
+		})
+	}
+	if stats, ok := Stats.(*RedisStats); ok {
+		health.AddCheck("redis", func(ctx context.Context) error {
+			return stats.client.Ping(ctx).Err()
+		})
+	}
+	switch config.Mode {
+	case ModeSqsToKafka, ModeKafkaToSqs:
+		health.AddCheck("kafka", func(ctx context.Context) error {
+			conn, err := kafka.DialContext(ctx, "tcp", config.KafkaAddress)
+			if err != nil {
+				return err
 			}
-
-			// Optionally, you can delete the message after processing
-			DeleteMessage(*message.ReceiptHandle)
-		}
+			return conn.Close()
+		})
+	}
+	if config.Mode == ModeKafkaToSqs {
+		health.AddConsumer(kafkaConsumer)
+	} else {
+		health.AddConsumer(sqsConsumer)
 	}
-
 }
 
 func main() {
 	config := loadConfig()
 
-	err := SetupSqs(config.SqsQueueName)
+	err := SetupSqs(config.SqsQueueName, config.SqsDlqName)
 	if err != nil {
 		log.Fatalf("unable to setup SQS, %v", err)
 		panic(err)
 	}
 
-	go StartSqsReader()
+	Messages = NewMessageLog(config.MessageLogSize)
+
+	err = SetupStats(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if config.IpInfoGrpcAddress != "" {
+		err = SetupIpInfo(config.IpInfoGrpcAddress)
+		if err != nil {
+			log.Fatalf("unable to setup ip-info-grpc client, %v", err)
+		}
+	}
+
+	setupHealthChecks(config)
+
+	shutdown, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	readerDone := make(chan struct{})
+
+	switch config.Mode {
+	case ModeConsume, ModeSqsToKafka:
+		process := processMessage
+		if config.Mode == ModeSqsToKafka {
+			SetupKafkaWriter(config.KafkaAddress, config.KafkaTopic)
+			process = forwardToKafka
+		}
+		config.Reader.DlqUrl = DlqUrl
+		reader, err := NewReader(sqsClient, SqsQueueUrl, config.Reader, process)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			reader.Run(shutdown)
+			close(readerDone)
+		}()
+	case ModeKafkaToSqs:
+		go func() {
+			if err := RunKafkaToSqs(shutdown, config.KafkaAddress, config.KafkaTopic, config.KafkaConsumerGroup); err != nil {
+				log.Fatal(err)
+			}
+			close(readerDone)
+		}()
+	default:
+		log.Fatalf("unknown mode %q", config.Mode)
+	}
+
 	router := gin.Default()
 	router.GET("/health", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+	router.GET("/livez", gin.WrapF(health.Livez))
+	router.GET("/readyz", gin.WrapF(health.Readyz))
+	router.GET("/stats", getStats)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/messages", listMessages)
+	router.GET("/dlq", listDlq)
+	router.POST("/dlq/redrive", redriveDlq)
+	server := &http.Server{Addr: "0.0.0.0:" + fmt.Sprint(config.Port), Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
 	fmt.Print("loaded")
-	router.Run("0.0.0.0:" + fmt.Sprint(config.Port))
+
+	<-shutdown.Done()
+	log.Print("shutting down")
+
+	// Polling has stopped; give in-flight messages and requests the timeout to finish.
+	// Anything left over is redelivered after its visibility timeout.
+	shutdownCtx, cancel := context.WithTimeout(ctx, config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to finish in-flight requests: %v", err)
+	}
+	select {
+	case <-readerDone:
+	case <-shutdownCtx.Done():
+		log.Print("gave up waiting for in-flight messages")
+	}
+	if KafkaWriter != nil {
+		if err := KafkaWriter.Close(); err != nil {
+			log.Printf("failed to flush kafka writer: %v", err)
+		}
+	}
+	if err := Stats.Close(); err != nil {
+		log.Printf("failed to close stats store: %v", err)
+	}
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/gin-gonic/gin"
+)
+
+// How the reader settled a message, in MessageRecord.Outcome.
+const (
+	OutcomeProcessed    = "processed"
+	OutcomeDropped      = "dropped"
+	OutcomeDeadLettered = "dead-lettered"
+	OutcomeRetrying     = "retrying"
+)
+
+const redactedValue = "[redacted]"
+
+// Attributes whose values GET /messages doesn't show: any whose name contains
+// one of these, case-insensitively. REDACTATTRIBUTES adds to the list.
+var redactedAttributes = []string{"authorization", "cookie", "token", "secret", "password", "api-key", "apikey", "session"}
+
+// MessageRecord
+// A message the reader settled, as listed by GET /messages
+type MessageRecord struct {
+	MessageId    string            `json:"message_id"`
+	Tenant       string            `json:"tenant"`
+	Body         string            `json:"body"`
+	Attributes   map[string]string `json:"attributes"`
+	ReceiveCount int               `json:"receive_count"`
+	Outcome      string            `json:"outcome"`
+	Error        string            `json:"error,omitempty"`
+	LatencyMs    float64           `json:"latency_ms"`
+	SettledAt    time.Time         `json:"settled_at"`
+}
+
+func newMessageRecord(message types.Message, outcome string, cause error, latency time.Duration) MessageRecord {
+	attributes := map[string]string{}
+	for key, value := range message.MessageAttributes {
+		attributes[key] = aws.ToString(value.StringValue)
+		if isRedacted(key) {
+			attributes[key] = redactedValue
+		}
+	}
+	// Same precedence as processMessage: the event's tenant, then the attribute.
+	tenant := attributes["x-pg-tenant"]
+	if visit, _, err := DecodeVisit(message); err == nil && visit.Tenant != "" {
+		tenant = visit.Tenant
+	}
+	record := MessageRecord{
+		MessageId:    aws.ToString(message.MessageId),
+		Tenant:       tenant,
+		Body:         aws.ToString(message.Body),
+		Attributes:   attributes,
+		ReceiveCount: receiveCount(message),
+		Outcome:      outcome,
+		LatencyMs:    float64(latency.Microseconds()) / 1000,
+		SettledAt:    time.Now().UTC(),
+	}
+	if cause != nil {
+		record.Error = cause.Error()
+	}
+	return record
+}
+
+func isRedacted(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range redactedAttributes {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// MessageLog
+// A ring of the last messages the reader settled
+type MessageLog struct {
+	mu      sync.Mutex
+	records []MessageRecord
+	next    int
+}
+
+var Messages = NewMessageLog(100)
+
+// NewMessageLog keeps the last size messages; with size 0 nothing is kept.
+func NewMessageLog(size int) *MessageLog {
+	return &MessageLog{records: make([]MessageRecord, 0, size)}
+}
+
+func (l *MessageLog) Add(record MessageRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case cap(l.records) == 0:
+	case len(l.records) < cap(l.records):
+		l.records = append(l.records, record)
+	default:
+		l.records[l.next] = record
+		l.next = (l.next + 1) % len(l.records)
+	}
+}
+
+// List returns the records of tenant, unless it is nil, with outcome, unless
+// it is "", newest first and at most limit of them.
+func (l *MessageLog) List(tenant *string, outcome string, limit int) []MessageRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	listed := []MessageRecord{}
+	for i := range l.records {
+		// Walk back from the newest, which is just before next.
+		record := l.records[(l.next-1-i+2*len(l.records))%len(l.records)]
+		if tenant != nil && record.Tenant != *tenant || outcome != "" && record.Outcome != outcome {
+			continue
+		}
+		listed = append(listed, record)
+		if len(listed) == limit {
+			break
+		}
+	}
+	return listed
+}
+
+// listMessages serves GET /messages?tenant=&outcome=&limit=.
+func listMessages(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+		return
+	}
+	outcome := c.Query("outcome")
+	switch outcome {
+	case "", OutcomeProcessed, OutcomeDropped, OutcomeDeadLettered, OutcomeRetrying:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "outcome must be one of processed, dropped, dead-lettered, retrying"})
+		return
+	}
+	var tenant *string
+	if t, ok := c.GetQuery("tenant"); ok {
+		tenant = &t
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": Messages.List(tenant, outcome, limit)})
+}
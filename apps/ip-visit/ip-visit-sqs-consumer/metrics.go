@@ -0,0 +1,13 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SkippedMessages
+// Messages the tenant filter released, served by GET /metrics
+var SkippedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ip_visit_sqs_consumer_skipped_messages_total",
+	Help: "Messages released unprocessed because their tenant doesn't match TENANTFILTER.",
+}, []string{"tenant"})
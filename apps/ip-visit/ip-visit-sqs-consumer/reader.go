@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/metalbear-co/playground/internal/health"
+)
+
+// SQS limits for one ReceiveMessage / DeleteMessageBatch call and for long polling.
+const (
+	maxSqsBatch    = 10
+	maxSqsWaitTime = 20 * time.Second
+)
+
+// Transient processing errors are retried in place this many times before
+// the message is left for redelivery.
+const processAttempts = 3
+
+// filterBackoff is the pause after a poll that only returned messages for
+// other tenants.
+const filterBackoff = time.Second
+
+// deleteFlushInterval bounds how long a processed message waits for its
+// DeleteMessageBatch when the batch doesn't fill up.
+const deleteFlushInterval = 200 * time.Millisecond
+
+// SqsApi
+// The SQS calls the consumer makes. *sqs.Client implements it, and so does
+// fakeQueue, the stand-in used by the tests.
+type SqsApi interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
+}
+
+// ReaderConfig
+// How many messages are processed at once, how long a poll waits for
+// messages, and how long a received message stays hidden from other consumers
+type ReaderConfig struct {
+	Concurrency       int
+	BatchSize         int
+	WaitTime          time.Duration
+	VisibilityTimeout time.Duration
+	// DlqUrl is where poison messages go; without it undecodable messages are
+	// dropped and failing ones are redelivered until SQS's own redrive policy,
+	// if any, moves them.
+	DlqUrl string
+	// MaxReceiveCount is how many receives a failing message gets before it is
+	// dead-lettered.
+	MaxReceiveCount int
+	// TenantFilter, when set, is a regex that limits processing to messages
+	// whose x-pg-tenant attribute matches; the rest are made visible again
+	// right away.
+	TenantFilter string
+}
+
+func (c ReaderConfig) validate() error {
+	if c.Concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1, got %d", c.Concurrency)
+	}
+	if c.BatchSize < 1 || c.BatchSize > maxSqsBatch {
+		return fmt.Errorf("batch size must be between 1 and %d, got %d", maxSqsBatch, c.BatchSize)
+	}
+	if c.WaitTime < 0 || c.WaitTime > maxSqsWaitTime {
+		return fmt.Errorf("wait time must be between 0 and %s, got %s", maxSqsWaitTime, c.WaitTime)
+	}
+	if c.VisibilityTimeout < 2*time.Second {
+		return fmt.Errorf("visibility timeout must be at least 2s, got %s", c.VisibilityTimeout)
+	}
+	if c.MaxReceiveCount < 1 {
+		return fmt.Errorf("max receive count must be at least 1, got %d", c.MaxReceiveCount)
+	}
+	if _, err := regexp.Compile(c.TenantFilter); err != nil {
+		return fmt.Errorf("invalid tenant filter, %w", err)
+	}
+	return nil
+}
+
+// Reader
+// Receives messages in batches and processes each one in a bounded pool of
+// workers. Visibility is extended while a message is worked on, and processed
+// messages are deleted in batches.
+type Reader struct {
+	client   SqsApi
+	queueUrl string
+	config   ReaderConfig
+	process  func(context.Context, types.Message) error
+
+	// fifo is set for .fifo queues, whose message groups are processed in order.
+	fifo bool
+	// tenantFilter is the compiled TenantFilter, nil without one.
+	tenantFilter *regexp.Regexp
+	// slots holds one token per free worker.
+	slots   chan struct{}
+	workers sync.WaitGroup
+	deletes chan string
+}
+
+func NewReader(client SqsApi, queueUrl string, config ReaderConfig, process func(context.Context, types.Message) error) (*Reader, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	var tenantFilter *regexp.Regexp
+	if config.TenantFilter != "" {
+		tenantFilter = regexp.MustCompile(config.TenantFilter) // checked by validate
+	}
+	slots := make(chan struct{}, config.Concurrency)
+	for range config.Concurrency {
+		slots <- struct{}{}
+	}
+	return &Reader{
+		client:       client,
+		queueUrl:     queueUrl,
+		config:       config,
+		process:      process,
+		fifo:         isFifoQueue(queueUrl),
+		tenantFilter: tenantFilter,
+		slots:        slots,
+		deletes:      make(chan string, maxSqsBatch),
+	}, nil
+}
+
+// Run
+// Poll until ctx is done, then wait for in-flight messages and their deletes.
+// Messages already received are processed to the end, not cancelled.
+func (r *Reader) Run(ctx context.Context) {
+	work := context.WithoutCancel(ctx)
+	deleterDone := make(chan struct{})
+	go func() {
+		r.deleteLoop()
+		close(deleterDone)
+	}()
+
+	failures := 0
+	for {
+		free := r.acquire(ctx)
+		if free == 0 {
+			break
+		}
+		result, err := r.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(r.queueUrl),
+			MaxNumberOfMessages:   int32(free),
+			WaitTimeSeconds:       int32(r.config.WaitTime / time.Second),
+			VisibilityTimeout:     int32(r.config.VisibilityTimeout / time.Second),
+			MessageAttributeNames: []string{"All"},
+			MessageSystemAttributeNames: []types.MessageSystemAttributeName{
+				types.MessageSystemAttributeNameApproximateReceiveCount,
+				types.MessageSystemAttributeNameSentTimestamp,
+				types.MessageSystemAttributeNameMessageGroupId,
+			},
+		})
+		if err != nil {
+			r.release(free)
+			if ctx.Err() != nil {
+				break
+			}
+			// Throttling, network or credential errors: keep polling, slower.
+			failures++
+			wait := backoff(failures, 500*time.Millisecond, 30*time.Second)
+			log.Printf("failed to receive messages, retrying in %s: %v", wait, err)
+			sleep(ctx, wait)
+			continue
+		}
+		failures = 0
+		health.Polled(sqsConsumer)
+		r.release(free - len(result.Messages))
+		messages := r.filter(result.Messages)
+		if len(messages) == 0 && len(result.Messages) > 0 {
+			// Only other tenants' messages: don't spin on them.
+			sleep(ctx, filterBackoff)
+		}
+		if r.fifo {
+			for _, group := range groupMessages(messages) {
+				r.workers.Add(1)
+				go r.handleGroup(work, group)
+			}
+			continue
+		}
+		for _, message := range messages {
+			r.workers.Add(1)
+			go func() {
+				defer r.workers.Done()
+				defer r.release(1)
+				stop := r.heartbeat(message)
+				defer stop()
+				r.handle(work, message, stop)
+			}()
+		}
+	}
+
+	r.workers.Wait()
+	close(r.deletes)
+	<-deleterDone
+}
+
+// filter releases the messages TenantFilter doesn't match, and their worker
+// slots, and returns the rest. Releasing still counts as a receive, so the
+// consumer that does process it sees a higher ApproximateReceiveCount. Since
+// settle only dead-letters after a failed attempt, that can make it give up on
+// a failing message sooner, but never dead-letter one it didn't try. On a FIFO
+// queue a released message releases the rest of its group in the batch too,
+// so no later message of the group overtakes it.
+func (r *Reader) filter(messages []types.Message) []types.Message {
+	if r.tenantFilter == nil {
+		return messages
+	}
+	released := map[string]bool{}
+	if r.fifo {
+		for _, message := range messages {
+			if !r.tenantFilter.MatchString(messageTenant(message)) {
+				released[messageGroupId(message)] = true
+			}
+		}
+	}
+	matched := messages[:0:0]
+	for _, message := range messages {
+		tenant := messageTenant(message)
+		if r.tenantFilter.MatchString(tenant) && !(r.fifo && released[messageGroupId(message)]) {
+			matched = append(matched, message)
+			continue
+		}
+		SkippedMessages.WithLabelValues(tenant).Inc()
+		r.release(1)
+		r.requeue(message)
+	}
+	return matched
+}
+
+func messageTenant(message types.Message) string {
+	if attr, ok := message.MessageAttributes["x-pg-tenant"]; ok {
+		return aws.ToString(attr.StringValue)
+	}
+	return ""
+}
+
+// requeue makes a received message visible again right away.
+func (r *Reader) requeue(message types.Message) {
+	_, err := r.client.ChangeMessageVisibility(context.Background(), &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(r.queueUrl),
+		ReceiptHandle:     message.ReceiptHandle,
+		VisibilityTimeout: 0,
+	})
+	if err != nil {
+		log.Printf("failed to release message %s: %v", *message.MessageId, err)
+	}
+}
+
+// acquire blocks for one free worker, then takes as many more as are free, up
+// to the batch size. It returns 0 once ctx is done.
+func (r *Reader) acquire(ctx context.Context) int {
+	select {
+	case <-ctx.Done():
+		return 0
+	case <-r.slots:
+	}
+	free := 1
+	for free < r.config.BatchSize {
+		select {
+		case <-r.slots:
+			free++
+		default:
+			return free
+		}
+	}
+	return free
+}
+
+func (r *Reader) release(n int) {
+	for range n {
+		r.slots <- struct{}{}
+	}
+}
+
+// handle processes one message, deletes or dead-letters it, and adds it to
+// Messages. It returns false when the message is left on the queue to be
+// retried. stopHeartbeat stops the message's heartbeat.
+func (r *Reader) handle(ctx context.Context, message types.Message, stopHeartbeat func()) bool {
+	start := time.Now()
+	outcome, err := r.settle(ctx, message, stopHeartbeat)
+	Messages.Add(newMessageRecord(message, outcome, err, time.Since(start)))
+	return outcome != OutcomeRetrying
+}
+
+// settle does the work of handle, and returns how the message was settled and
+// the error it failed with, if any.
+func (r *Reader) settle(ctx context.Context, message types.Message, stopHeartbeat func()) (string, error) {
+	// Only a failed attempt dead-letters a message. Redeliveries after a crash
+	// or a deploy still get processed; a message that keeps crashing the
+	// consumer is left to the queue's own redrive policy.
+	receives := receiveCount(message)
+	err := r.processWithRetry(ctx, message)
+	switch {
+	case err == nil:
+		r.deletes <- *message.ReceiptHandle
+		return OutcomeProcessed, nil
+	case errors.Is(err, errUndecodable):
+		// Redelivering it won't help.
+		if r.config.DlqUrl != "" {
+			return r.deadLetterOutcome(message, DlqReasonUndecodable, err)
+		}
+		log.Printf("dropping message %s: %v", *message.MessageId, err)
+		r.deletes <- *message.ReceiptHandle
+		return OutcomeDropped, err
+	case receives >= r.config.MaxReceiveCount && r.config.DlqUrl != "":
+		return r.deadLetterOutcome(message, DlqReasonMaxReceives, err)
+	default:
+		// Leave it on the queue, and back off its redelivery the more often it failed.
+		wait := backoff(receives, time.Second, 5*time.Minute)
+		log.Printf("failed to process message %s (receive %d), retrying in %s: %v", *message.MessageId, receives, wait, err)
+		// A heartbeat landing after this would overwrite the backoff.
+		stopHeartbeat()
+		_, delayErr := r.client.ChangeMessageVisibility(context.Background(), &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(r.queueUrl),
+			ReceiptHandle:     message.ReceiptHandle,
+			VisibilityTimeout: int32(wait / time.Second),
+		})
+		if delayErr != nil {
+			log.Printf("failed to delay message %s: %v", *message.MessageId, delayErr)
+		}
+		return OutcomeRetrying, err
+	}
+}
+
+func (r *Reader) deadLetterOutcome(message types.Message, reason string, cause error) (string, error) {
+	if r.deadLetter(message, reason, cause) {
+		return OutcomeDeadLettered, cause
+	}
+	return OutcomeRetrying, cause
+}
+
+// processWithRetry retries transient errors with a short backoff. The
+// heartbeat keeps the message hidden meanwhile.
+func (r *Reader) processWithRetry(ctx context.Context, message types.Message) error {
+	for attempt := 1; ; attempt++ {
+		err := r.process(ctx, message)
+		if err == nil || errors.Is(err, errUndecodable) || attempt == processAttempts {
+			return err
+		}
+		sleep(ctx, backoff(attempt, 200*time.Millisecond, 2*time.Second))
+	}
+}
+
+// backoff doubles base for every attempt after the first, up to limit.
+func backoff(attempt int, base, limit time.Duration) time.Duration {
+	wait := base
+	for i := 1; i < attempt && wait < limit; i++ {
+		wait *= 2
+	}
+	return min(wait, limit)
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// heartbeat keeps message hidden, by extending its visibility every half
+// timeout, until stop is called. stop waits for an extension in flight, so a
+// visibility change made after it sticks. It can be called more than once.
+func (r *Reader) heartbeat(message types.Message) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(r.config.VisibilityTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := r.client.ChangeMessageVisibility(context.Background(), &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(r.queueUrl),
+					ReceiptHandle:     message.ReceiptHandle,
+					VisibilityTimeout: int32(r.config.VisibilityTimeout / time.Second),
+				})
+				if err != nil {
+					log.Printf("failed to extend visibility of message %s: %v", *message.MessageId, err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+}
+
+// deleteLoop deletes processed messages in batches of up to 10, flushing
+// partial batches every deleteFlushInterval, until deletes is closed.
+func (r *Reader) deleteLoop() {
+	ticker := time.NewTicker(deleteFlushInterval)
+	defer ticker.Stop()
+
+	batch := []types.DeleteMessageBatchRequestEntry{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		r.deleteBatch(batch)
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case receiptHandle, ok := <-r.deletes:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, types.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(len(batch))),
+				ReceiptHandle: aws.String(receiptHandle),
+			})
+			if len(batch) == maxSqsBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (r *Reader) deleteBatch(batch []types.DeleteMessageBatchRequestEntry) {
+	// Deletes outlive the polling context, so messages processed during
+	// shutdown are still removed.
+	result, err := r.client.DeleteMessageBatch(context.Background(), &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(r.queueUrl),
+		Entries:  batch,
+	})
+	if err != nil {
+		log.Printf("failed to delete %d message(s): %v", len(batch), err)
+		return
+	}
+	for _, failed := range result.Failed {
+		log.Printf("failed to delete message: %s %s", aws.ToString(failed.Code), aws.ToString(failed.Message))
+	}
+}
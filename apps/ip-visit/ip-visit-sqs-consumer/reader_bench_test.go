@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// benchLatency is added to every SQS call.
+	benchLatency = 5 * time.Millisecond
+	// benchWork is added to every message on top of the real decoding and
+	// stats, standing in for the ip-info-grpc round trip.
+	benchWork = 2 * time.Millisecond
+)
+
+// BenchmarkReader measures the reader's throughput against a fakeQueue, first
+// as the old serial reader (one message per poll, one worker), then with full
+// batches at several concurrencies:
+//
+//	go test ./apps/ip-visit/ip-visit-sqs-consumer -run '^$' -bench Reader
+func BenchmarkReader(b *testing.B) {
+	runs := []struct {
+		name   string
+		config ReaderConfig
+	}{
+		{"serial", ReaderConfig{Concurrency: 1, BatchSize: 1}},
+		{"concurrency=1", ReaderConfig{Concurrency: 1, BatchSize: maxSqsBatch}},
+		{"concurrency=10", ReaderConfig{Concurrency: 10, BatchSize: maxSqsBatch}},
+		{"concurrency=50", ReaderConfig{Concurrency: 50, BatchSize: maxSqsBatch}},
+	}
+	logVisits = false
+	b.Cleanup(func() { logVisits = true })
+	for _, run := range runs {
+		b.Run(run.name, func(b *testing.B) {
+			run.config.VisibilityTimeout = 30 * time.Second
+			run.config.MaxReceiveCount = 5
+			benchmarkReader(b, run.config)
+		})
+	}
+}
+
+// benchmarkReader drains b.N messages from a fakeQueue with one reader.
+func benchmarkReader(b *testing.B, config ReaderConfig) {
+	queue := newFakeQueue(benchLatency)
+	for i := range b.N {
+		body, _ := json.Marshal(IpMessage{
+			Version:   2,
+			EventId:   "bench-" + strconv.Itoa(i),
+			Timestamp: time.Now().UTC(),
+			Ip:        "10.0.0." + strconv.Itoa(i%250),
+			Tenant:    "bench",
+			Path:      "/",
+		})
+		queue.SendMessage(context.Background(), &sqs.SendMessageInput{MessageBody: aws.String(string(body))})
+	}
+	// Each run gets fresh stats, so event IDs aren't deduplicated across runs.
+	Stats = NewMemoryStats()
+
+	reader, err := NewReader(queue, "bench", config, func(ctx context.Context, message types.Message) error {
+		time.Sleep(benchWork)
+		return processMessage(ctx, message)
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.ResetTimer()
+	done := make(chan struct{})
+	go func() {
+		reader.Run(ctx)
+		close(done)
+	}()
+	for queue.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msg/s")
+	cancel()
+	<-done
+}
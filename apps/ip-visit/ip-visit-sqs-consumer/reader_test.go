@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+func TestHeartbeatStopWaitsForExtension(t *testing.T) {
+	// Every call takes 15ms, so stopping 2ms after the first tick catches an
+	// extension in flight.
+	queue := newFakeQueue(15 * time.Millisecond)
+	queue.SendMessage(context.Background(), &sqs.SendMessageInput{MessageBody: aws.String("{}")})
+	messages := queue.receive(&sqs.ReceiveMessageInput{MaxNumberOfMessages: 1, VisibilityTimeout: 60})
+	// Sub-second timeouts round down to 0, so each extension makes the
+	// message visible right away.
+	r := &Reader{client: queue, queueUrl: "queue", config: ReaderConfig{VisibilityTimeout: 20 * time.Millisecond}}
+
+	stop := r.heartbeat(messages[0])
+	time.Sleep(12 * time.Millisecond)
+	stop()
+	stop()
+
+	// What settle's backoff does once the heartbeat is stopped.
+	hiddenUntil := time.Now().Add(time.Hour)
+	queue.mu.Lock()
+	queue.receipts[*messages[0].ReceiptHandle].visibleAt = hiddenUntil
+	queue.mu.Unlock()
+
+	time.Sleep(30 * time.Millisecond)
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if got := queue.receipts[*messages[0].ReceiptHandle].visibleAt; !got.Equal(hiddenUntil) {
+		t.Errorf("a heartbeat after stop() moved the visibility to %s", got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Storage backends for tenant aggregates, selected with STATSSTORE.
+const (
+	StatsStoreMemory = "memory"
+	StatsStoreRedis  = "redis"
+)
+
+// SQS delivers at least once, so visits are deduplicated by event ID for
+// this long.
+const dedupWindow = 24 * time.Hour
+
+// TenantStats
+// Aggregates of the visits consumed for one tenant ("" for untenanted visits)
+type TenantStats struct {
+	Tenant         string           `json:"tenant"`
+	Visits         int64            `json:"visits"`
+	UniqueVisitors int64            `json:"unique_visitors"`
+	Clients        map[string]int64 `json:"clients"`
+	Decisions      map[string]int64 `json:"decisions"`
+	Paths          map[string]int64 `json:"paths"`
+	Tags           map[string]int64 `json:"tags"`
+	LastSeen       time.Time        `json:"last_seen"`
+}
+
+func newTenantStats(tenant string) *TenantStats {
+	return &TenantStats{
+		Tenant:    tenant,
+		Clients:   map[string]int64{},
+		Decisions: map[string]int64{},
+		Paths:     map[string]int64{},
+		Tags:      map[string]int64{},
+	}
+}
+
+// StatsStore
+// Per-tenant aggregates of consumed visits
+type StatsStore interface {
+	// Record adds a visit to its tenant's aggregates. Visits whose event ID was
+	// already recorded within dedupWindow are ignored.
+	Record(ctx context.Context, visit *IpMessage) error
+	// Stats returns the aggregates of every tenant, sorted by tenant.
+	Stats(ctx context.Context) ([]TenantStats, error)
+	Close() error
+}
+
+var Stats StatsStore
+
+// SetupStats
+// Initialize the configured stats store
+func SetupStats(config Config) error {
+	switch config.StatsStore {
+	case "", StatsStoreMemory:
+		Stats = NewMemoryStats()
+	case StatsStoreRedis:
+		stats, err := NewRedisStats(ctx, config.RedisAddress)
+		if err != nil {
+			return fmt.Errorf("unable to connect to redis, %w", err)
+		}
+		Stats = stats
+	default:
+		return fmt.Errorf("unknown stats store %q", config.StatsStore)
+	}
+	return nil
+}
+
+// visitSeenAt is when the visit happened, falling back to now for version 1
+// events without a timestamp.
+func visitSeenAt(visit *IpMessage) time.Time {
+	if visit.Timestamp.IsZero() {
+		return time.Now().UTC()
+	}
+	return visit.Timestamp
+}
+
+func sortByTenant(stats []TenantStats) {
+	slices.SortFunc(stats, func(a, b TenantStats) int { return strings.Compare(a.Tenant, b.Tenant) })
+}
+
+// getStats serves GET /stats, optionally limited to one tenant with ?tenant=.
+func getStats(c *gin.Context) {
+	stats, err := Stats.Stats(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if tenant, ok := c.GetQuery("tenant"); ok {
+		filtered := []TenantStats{}
+		for _, s := range stats {
+			if s.Tenant == tenant {
+				filtered = append(filtered, s)
+			}
+		}
+		stats = filtered
+	}
+	c.JSON(http.StatusOK, gin.H{"tenants": stats})
+}
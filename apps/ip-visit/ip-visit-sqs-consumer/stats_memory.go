@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+)
+
+// MemoryStats
+// In-process StatsStore. Aggregates are lost on restart and not shared
+// between replicas.
+type MemoryStats struct {
+	mu       sync.Mutex
+	tenants  map[string]*TenantStats
+	visitors map[string]map[string]struct{}
+	// Event IDs seen in the current and the previous dedupWindow. Rotating
+	// the two generations keeps every ID for at least dedupWindow without
+	// scanning for expired ones.
+	seen       map[string]struct{}
+	seenBefore map[string]struct{}
+	rotatedAt  time.Time
+}
+
+func NewMemoryStats() *MemoryStats {
+	return &MemoryStats{
+		tenants:    map[string]*TenantStats{},
+		visitors:   map[string]map[string]struct{}{},
+		seen:       map[string]struct{}{},
+		seenBefore: map[string]struct{}{},
+		rotatedAt:  time.Now(),
+	}
+}
+
+func (s *MemoryStats) Record(ctx context.Context, visit *IpMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if visit.EventId != "" {
+		if s.duplicate(visit.EventId, time.Now()) {
+			return nil
+		}
+	}
+
+	stats, ok := s.tenants[visit.Tenant]
+	if !ok {
+		stats = newTenantStats(visit.Tenant)
+		s.tenants[visit.Tenant] = stats
+		s.visitors[visit.Tenant] = map[string]struct{}{}
+	}
+	stats.Visits++
+	s.visitors[visit.Tenant][visit.Ip] = struct{}{}
+	stats.UniqueVisitors = int64(len(s.visitors[visit.Tenant]))
+	if visit.Client != "" {
+		stats.Clients[visit.Client]++
+	}
+	if visit.Decision != "" {
+		stats.Decisions[visit.Decision]++
+	}
+	if visit.Path != "" {
+		stats.Paths[visit.Path]++
+	}
+	for _, tag := range infoTags(visit) {
+		stats.Tags[tag]++
+	}
+	if seenAt := visitSeenAt(visit); seenAt.After(stats.LastSeen) {
+		stats.LastSeen = seenAt
+	}
+	return nil
+}
+
+// duplicate reports whether id was already seen and remembers it otherwise.
+// IDs are forgotten between one and two dedupWindows after they were last seen.
+func (s *MemoryStats) duplicate(id string, now time.Time) bool {
+	if now.Sub(s.rotatedAt) >= dedupWindow {
+		s.seenBefore, s.seen = s.seen, map[string]struct{}{}
+		if now.Sub(s.rotatedAt) >= 2*dedupWindow {
+			// Idle for a whole generation; everything seen is stale.
+			clear(s.seenBefore)
+		}
+		s.rotatedAt = now
+	}
+	if _, ok := s.seen[id]; ok {
+		return true
+	}
+	if _, ok := s.seenBefore[id]; ok {
+		s.seen[id] = struct{}{}
+		return true
+	}
+	s.seen[id] = struct{}{}
+	return false
+}
+
+func (s *MemoryStats) Stats(ctx context.Context) ([]TenantStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make([]TenantStats, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		copied := *t
+		copied.Clients = maps.Clone(t.Clients)
+		copied.Decisions = maps.Clone(t.Decisions)
+		copied.Paths = maps.Clone(t.Paths)
+		copied.Tags = maps.Clone(t.Tags)
+		stats = append(stats, copied)
+	}
+	sortByTenant(stats)
+	return stats, nil
+}
+
+func (s *MemoryStats) Close() error {
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStatsDuplicate(t *testing.T) {
+	s := NewMemoryStats()
+	start := s.rotatedAt
+
+	steps := []struct {
+		name  string
+		id    string
+		after time.Duration
+		want  bool
+	}{
+		{name: "first sighting", id: "a", after: 0, want: false},
+		{name: "repeat", id: "a", after: time.Hour, want: true},
+		{name: "other id", id: "b", after: time.Hour, want: false},
+		{name: "previous generation", id: "a", after: dedupWindow + time.Hour, want: true},
+		{name: "refreshed into the current generation", id: "a", after: 2*dedupWindow + time.Hour, want: true},
+		{name: "expired after two rotations", id: "b", after: 2*dedupWindow + time.Hour, want: false},
+		{name: "idle for two windows", id: "a", after: 5 * dedupWindow, want: false},
+	}
+	for _, step := range steps {
+		if got := s.duplicate(step.id, start.Add(step.after)); got != step.want {
+			t.Errorf("%s: duplicate(%q) = %v, want %v", step.name, step.id, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const statsKey = "ip-visit-sqs-consumer-stats-"
+
+// RedisStats
+// StatsStore shared by every replica. Each tenant has a hash of counters
+// ("visits", "client:<class>", "decision:<action>", "path:<path>",
+// "tag:<tag>") and a HyperLogLog of visitors; a sorted set of tenants scored
+// by their last visit lists them all.
+type RedisStats struct {
+	client *redis.Client
+}
+
+func NewRedisStats(ctx context.Context, address string) (*RedisStats, error) {
+	client := redis.NewClient(&redis.Options{Addr: address})
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisStats{client: client}, nil
+}
+
+func (s *RedisStats) Record(ctx context.Context, visit *IpMessage) error {
+	seenKey := statsKey + "seen-" + visit.EventId
+	if visit.EventId != "" {
+		first, err := s.client.SetNX(ctx, seenKey, 1, dedupWindow).Result()
+		if err != nil || !first {
+			return err
+		}
+	}
+
+	tenantKey := statsKey + "tenant-" + visit.Tenant
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, tenantKey, "visits", 1)
+		if visit.Client != "" {
+			pipe.HIncrBy(ctx, tenantKey, "client:"+visit.Client, 1)
+		}
+		if visit.Decision != "" {
+			pipe.HIncrBy(ctx, tenantKey, "decision:"+visit.Decision, 1)
+		}
+		if visit.Path != "" {
+			pipe.HIncrBy(ctx, tenantKey, "path:"+visit.Path, 1)
+		}
+		for _, tag := range infoTags(visit) {
+			pipe.HIncrBy(ctx, tenantKey, "tag:"+tag, 1)
+		}
+		pipe.PFAdd(ctx, statsKey+"visitors-"+visit.Tenant, visit.Ip)
+		pipe.ZAddGT(ctx, statsKey+"tenants", redis.Z{Score: float64(visitSeenAt(visit).UnixMilli()), Member: visit.Tenant})
+		return nil
+	})
+	if err != nil && visit.EventId != "" {
+		// Let the redelivered message be recorded.
+		s.client.Del(ctx, seenKey)
+	}
+	return err
+}
+
+func (s *RedisStats) Stats(ctx context.Context) ([]TenantStats, error) {
+	tenants, err := s.client.ZRangeWithScores(ctx, statsKey+"tenants", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := s.client.Pipeline()
+	counters := make([]*redis.MapStringStringCmd, len(tenants))
+	visitors := make([]*redis.IntCmd, len(tenants))
+	for i, z := range tenants {
+		tenant := z.Member.(string)
+		counters[i] = pipe.HGetAll(ctx, statsKey+"tenant-"+tenant)
+		visitors[i] = pipe.PFCount(ctx, statsKey+"visitors-"+tenant)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	stats := make([]TenantStats, 0, len(tenants))
+	for i, z := range tenants {
+		t := newTenantStats(z.Member.(string))
+		t.UniqueVisitors = visitors[i].Val()
+		t.LastSeen = time.UnixMilli(int64(z.Score)).UTC()
+		for field, value := range counters[i].Val() {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			kind, name, _ := strings.Cut(field, ":")
+			switch kind {
+			case "visits":
+				t.Visits = n
+			case "client":
+				t.Clients[name] = n
+			case "decision":
+				t.Decisions[name] = n
+			case "path":
+				t.Paths[name] = n
+			case "tag":
+				t.Tags[name] = n
+			}
+		}
+		stats = append(stats, *t)
+	}
+	// ZRange orders by last visit; /stats lists tenants by name.
+	sortByTenant(stats)
+	return stats, nil
+}
+
+func (s *RedisStats) Close() error {
+	return s.client.Close()
+}
@@ -196,7 +196,7 @@ func (r *cronRunner) emitAndMark(ctx context.Context, row dbRow) error {
 	}
 
 	// Light up the CronJob Z stage in the UI directly (the gateway owns the store).
-	r.store.add(TraceEvent{
+	r.store.emit(TraceEvent{
 		TraceID: row.TraceID, Stage: "z", Service: "cronjob-z", Session: row.Session,
 		Message: "saw changed DB state — emitted event to " + r.outputTopic,
 		TS:      time.Now().UnixMilli(),
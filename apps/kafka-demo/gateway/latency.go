@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Per-hop latencies, from the TS of the first event each stage records. They
+// show how much a service run locally through mirrord adds over the in-cluster
+// one: compare its session against production ("") on GET /stats, or the
+// kafka_demo_hop_latency_seconds histograms on GET /metrics.
+
+const (
+	hopGatewayToA = "gateway->a"
+	hopAToB       = "a->b"
+	hopBToC       = "b->c"    // the Kafka chain
+	hopBToZToC    = "b->z->c" // the event-driven flow, through the DB and CronJob Z
+	hopEndToEnd   = "end-to-end"
+)
+
+const (
+	// latencySamples is how many recent latencies per hop the percentiles on
+	// GET /stats are computed from.
+	latencySamples = 1000
+	// latencyGrace is how long after the done event a trace is measured, so
+	// events of earlier stages still in flight on other partitions make it.
+	latencyGrace = 2 * time.Second
+	// maxLatencySessions caps the sessions measured separately. Session names
+	// come from clients, so the ones past the cap share otherSessions.
+	maxLatencySessions = 20
+	// latencySessionIdle is how long a session is kept after its last trace.
+	latencySessionIdle = 30 * time.Minute
+)
+
+// otherSessions groups the sessions past maxLatencySessions. The parentheses
+// keep it from colliding with a real session name.
+const otherSessions = "(other)"
+
+// latencyBuckets are the histogram bounds, in seconds. The event-driven hops
+// wait on the CronJob Z schedule, hence the long tail.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// hopLatency is one hop of a trace, attributed to the service it ends at.
+type hopLatency struct {
+	hop     string
+	service string
+	ms      int64
+}
+
+// traceHops measures the hops of a completed trace's events, sorted by TS.
+// Hops with a stage missing are left out.
+func traceHops(events []TraceEvent) []hopLatency {
+	first := make(map[string]TraceEvent)
+	var done *TraceEvent
+	for i, ev := range events {
+		if _, ok := first[ev.Stage]; !ok {
+			first[ev.Stage] = ev
+		}
+		if ev.Done && done == nil {
+			done = &events[i]
+		}
+	}
+	var hops []hopLatency
+	measure := func(hop, from string, to TraceEvent) {
+		if start, ok := first[from]; ok {
+			hops = append(hops, hopLatency{hop: hop, service: to.Service, ms: to.TS - start.TS})
+		}
+	}
+	if a, ok := first["a"]; ok {
+		measure(hopGatewayToA, "gateway", a)
+	}
+	if b, ok := first["b"]; ok {
+		measure(hopAToB, "a", b)
+	}
+	if c, ok := first["c"]; ok {
+		if _, ok := first["z"]; ok {
+			measure(hopBToZToC, "b", c)
+		} else {
+			measure(hopBToC, "b", c)
+		}
+	}
+	if done != nil {
+		measure(hopEndToEnd, "gateway", *done)
+	}
+	return hops
+}
+
+// HopStats are the latency percentiles of one hop, in milliseconds.
+type HopStats struct {
+	Hop   string `json:"hop"`
+	Count int64  `json:"count"` // traces measured, not only the ones sampled
+	P50Ms int64  `json:"p50Ms"`
+	P90Ms int64  `json:"p90Ms"`
+	P99Ms int64  `json:"p99Ms"`
+	MaxMs int64  `json:"maxMs"`
+}
+
+// latencySample keeps a hop's latest latencySamples latencies.
+type latencySample struct {
+	count  int64
+	values []int64
+	next   int
+}
+
+func (s *latencySample) add(ms int64) {
+	s.count++
+	if len(s.values) < latencySamples {
+		s.values = append(s.values, ms)
+		return
+	}
+	s.values[s.next] = ms
+	s.next = (s.next + 1) % latencySamples
+}
+
+func (s *latencySample) stats(hop string) HopStats {
+	sorted := slices.Clone(s.values)
+	slices.Sort(sorted)
+	// Nearest rank.
+	percentile := func(p int) int64 {
+		return sorted[(len(sorted)*p+99)/100-1]
+	}
+	return HopStats{
+		Hop:   hop,
+		Count: s.count,
+		P50Ms: percentile(50),
+		P90Ms: percentile(90),
+		P99Ms: percentile(99),
+		MaxMs: sorted[len(sorted)-1],
+	}
+}
+
+type latencyKey struct{ group, hop string }
+
+// latencyStats aggregates hop latencies per session and per service.
+type latencyStats struct {
+	// histograms is kafka_demo_hop_latency_seconds; main registers it.
+	histograms *prometheus.HistogramVec
+
+	mu        sync.Mutex
+	bySession map[latencyKey]*latencySample
+	byService map[latencyKey]*latencySample
+	sessions  map[string]time.Time // when each session last recorded a trace
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{
+		histograms: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kafka_demo_hop_latency_seconds",
+			Help:    "Latency of each hop of the chain, from trace events.",
+			Buckets: latencyBuckets,
+		}, []string{"hop", "session", "service"}),
+		bySession: make(map[latencyKey]*latencySample),
+		byService: make(map[latencyKey]*latencySample),
+		sessions:  make(map[string]time.Time),
+	}
+}
+
+func (l *latencyStats) record(session string, hops []hopLatency) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.expire(now)
+	session = l.track(session, now)
+	for _, h := range hops {
+		sample(l.bySession, latencyKey{session, h.hop}).add(h.ms)
+		sample(l.byService, latencyKey{h.service, h.hop}).add(h.ms)
+		l.histograms.WithLabelValues(h.hop, session, h.service).Observe(float64(h.ms) / 1000)
+	}
+}
+
+// track marks session as active at now and returns the name to record it
+// under: itself, or otherSessions once maxLatencySessions are tracked.
+func (l *latencyStats) track(session string, now time.Time) string {
+	if _, ok := l.sessions[session]; !ok && len(l.sessions) >= maxLatencySessions {
+		session = otherSessions
+	}
+	l.sessions[session] = now
+	return session
+}
+
+// expire forgets the sessions that recorded nothing for latencySessionIdle,
+// along with their samples and histograms.
+func (l *latencyStats) expire(now time.Time) {
+	for session, seen := range l.sessions {
+		if now.Sub(seen) < latencySessionIdle {
+			continue
+		}
+		delete(l.sessions, session)
+		for key := range l.bySession {
+			if key.group == session {
+				delete(l.bySession, key)
+			}
+		}
+		l.histograms.DeletePartialMatch(prometheus.Labels{"session": session})
+	}
+}
+
+func sample(samples map[latencyKey]*latencySample, key latencyKey) *latencySample {
+	if samples[key] == nil {
+		samples[key] = &latencySample{}
+	}
+	return samples[key]
+}
+
+// follow measures every trace that completes in store, latencyGrace after its
+// done event, until ctx is done.
+func (l *latencyStats) follow(ctx context.Context, store *traceStore) {
+	// A done event dropped because this falls behind only misses the stats.
+	done, unsubscribe := store.feed.subscribe(func(ev TraceEvent) bool { return ev.Done })
+	defer unsubscribe()
+	measured := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-done:
+			// A trace is measured once, however many done events it gets.
+			if measured[ev.TraceID] {
+				continue
+			}
+			measured[ev.TraceID] = true
+			time.AfterFunc(latencyGrace, func() { l.measure(ctx, store, ev) })
+			if len(measured) > maxTraces*10 {
+				clear(measured)
+			}
+		}
+	}
+}
+
+func (l *latencyStats) measure(ctx context.Context, store *traceStore, done TraceEvent) {
+	events, err := store.get(ctx, done.TraceID)
+	if err != nil {
+		log.Printf("latency: get %s: %v", done.TraceID, err)
+		return
+	}
+	l.record(done.Session, traceHops(events))
+}
+
+// GroupStats are the hop latencies of one session or service.
+type GroupStats struct {
+	// Only one is set; Session may be "", production.
+	Session *string    `json:"session,omitempty"`
+	Service *string    `json:"service,omitempty"`
+	Hops    []HopStats `json:"hops"`
+}
+
+// hopOrder sorts hops along the chain rather than by name.
+var hopOrder = []string{hopGatewayToA, hopAToB, hopBToC, hopBToZToC, hopEndToEnd}
+
+func groupStats(samples map[latencyKey]*latencySample, bySession bool) []GroupStats {
+	groups := make(map[string]*GroupStats)
+	var names []string
+	for _, hop := range hopOrder {
+		for key, s := range samples {
+			if key.hop != hop {
+				continue
+			}
+			g := groups[key.group]
+			if g == nil {
+				name := key.group
+				g = &GroupStats{}
+				if bySession {
+					g.Session = &name
+				} else {
+					g.Service = &name
+				}
+				groups[key.group] = g
+				names = append(names, key.group)
+			}
+			g.Hops = append(g.Hops, s.stats(hop))
+		}
+	}
+	slices.Sort(names)
+	out := make([]GroupStats, 0, len(names))
+	for _, name := range names {
+		out = append(out, *groups[name])
+	}
+	return out
+}
+
+// getStats serves GET /stats: hop latency percentiles per session ("" is
+// production) and per service.
+func (l *latencyStats) getStats(c *gin.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(time.Now())
+	// PureJSON keeps the hop names' ">" readable.
+	c.PureJSON(http.StatusOK, gin.H{
+		"sessions": groupStats(l.bySession, true),
+		"services": groupStats(l.byService, false),
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTraceHops(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []TraceEvent
+		want   []hopLatency
+	}{
+		{
+			name: "kafka chain",
+			events: []TraceEvent{
+				{Stage: "gateway", Service: "gateway", TS: 1000},
+				{Stage: "a", Service: "service-a", TS: 1010},
+				{Stage: "b", Service: "service-b", TS: 1030},
+				{Stage: "c", Service: "service-c", TS: 1060, Done: true},
+			},
+			want: []hopLatency{
+				{hop: hopGatewayToA, service: "service-a", ms: 10},
+				{hop: hopAToB, service: "service-b", ms: 20},
+				{hop: hopBToC, service: "service-c", ms: 30},
+				{hop: hopEndToEnd, service: "service-c", ms: 60},
+			},
+		},
+		{
+			name: "event-driven flow through z",
+			events: []TraceEvent{
+				{Stage: "gateway", Service: "gateway", TS: 1000},
+				{Stage: "a", Service: "service-a", TS: 1010},
+				{Stage: "b", Service: "service-b", TS: 1030},
+				{Stage: "z", Service: "cronjob-z", TS: 6000},
+				{Stage: "c", Service: "service-c", TS: 6030, Done: true},
+			},
+			want: []hopLatency{
+				{hop: hopGatewayToA, service: "service-a", ms: 10},
+				{hop: hopAToB, service: "service-b", ms: 20},
+				{hop: hopBToZToC, service: "service-c", ms: 5000},
+				{hop: hopEndToEnd, service: "service-c", ms: 5030},
+			},
+		},
+		{
+			name: "first event of each stage counts",
+			events: []TraceEvent{
+				{Stage: "gateway", Service: "gateway", TS: 1000},
+				{Stage: "a", Service: "service-a", TS: 1010},
+				{Stage: "a", Service: "service-a", TS: 1500},
+				{Stage: "c", Service: "service-c", TS: 1600, Done: true},
+				{Stage: "c", Service: "service-c", TS: 1700, Done: true},
+			},
+			want: []hopLatency{
+				{hop: hopGatewayToA, service: "service-a", ms: 10},
+				{hop: hopEndToEnd, service: "service-c", ms: 600},
+			},
+		},
+		{
+			name: "missing gateway event",
+			events: []TraceEvent{
+				{Stage: "a", Service: "service-a", TS: 1010},
+				{Stage: "b", Service: "service-b", TS: 1030},
+			},
+			want: []hopLatency{{hop: hopAToB, service: "service-b", ms: 20}},
+		},
+		{name: "no events"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := traceHops(tt.events); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("traceHops() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatencySampleStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int64
+		want   HopStats
+	}{
+		{
+			name:   "one value",
+			values: []int64{42},
+			want:   HopStats{Hop: "h", Count: 1, P50Ms: 42, P90Ms: 42, P99Ms: 42, MaxMs: 42},
+		},
+		{
+			name:   "nearest rank",
+			values: []int64{10, 1, 9, 2, 8, 3, 7, 4, 6, 5},
+			want:   HopStats{Hop: "h", Count: 10, P50Ms: 5, P90Ms: 9, P99Ms: 10, MaxMs: 10},
+		},
+		{
+			name:   "1..100",
+			values: sequence(1, 100),
+			want:   HopStats{Hop: "h", Count: 100, P50Ms: 50, P90Ms: 90, P99Ms: 99, MaxMs: 100},
+		},
+		{
+			// Only the latest latencySamples count towards the percentiles.
+			name:   "ring buffer",
+			values: append(sequence(100000, 100000+latencySamples-1), sequence(1, latencySamples)...),
+			want:   HopStats{Hop: "h", Count: 2 * latencySamples, P50Ms: 500, P90Ms: 900, P99Ms: 990, MaxMs: latencySamples},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &latencySample{}
+			for _, v := range tt.values {
+				s.add(v)
+			}
+			if got := s.stats("h"); got != tt.want {
+				t.Errorf("stats() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func sequence(from, to int64) []int64 {
+	var out []int64
+	for v := from; v <= to; v++ {
+		out = append(out, v)
+	}
+	return out
+}
+
+func TestLatencyStatsRecord(t *testing.T) {
+	l := newLatencyStats()
+	hops := []hopLatency{{hop: hopGatewayToA, service: "service-a", ms: 10}, {hop: hopAToB, service: "service-b", ms: 20}}
+	l.record("", hops)
+	l.record("alice", hops)
+	l.record("alice", []hopLatency{{hop: hopGatewayToA, service: "service-a", ms: 30}})
+
+	if got := l.bySession[latencyKey{"alice", hopGatewayToA}].count; got != 2 {
+		t.Errorf("alice %s count = %d, want 2", hopGatewayToA, got)
+	}
+	if got := l.byService[latencyKey{"service-a", hopGatewayToA}].count; got != 3 {
+		t.Errorf("service-a %s count = %d, want 3", hopGatewayToA, got)
+	}
+	// One series per hop, session and service.
+	if got := testutil.CollectAndCount(l.histograms); got != 4 {
+		t.Errorf("got %d histogram series, want 4", got)
+	}
+}
+
+func TestLatencyStatsSessionCap(t *testing.T) {
+	l := newLatencyStats()
+	hops := []hopLatency{{hop: hopEndToEnd, service: "service-c", ms: 10}}
+	for i := range maxLatencySessions + 5 {
+		l.record("session-"+strconv.Itoa(i), hops)
+	}
+	// A session tracked before the cap keeps its own bucket.
+	l.record("session-0", hops)
+
+	if got := len(l.sessions); got != maxLatencySessions+1 {
+		t.Errorf("tracking %d sessions, want %d and %q", got, maxLatencySessions, otherSessions)
+	}
+	if got := l.bySession[latencyKey{otherSessions, hopEndToEnd}].count; got != 5 {
+		t.Errorf("%s count = %d, want 5", otherSessions, got)
+	}
+	if got := l.bySession[latencyKey{"session-0", hopEndToEnd}].count; got != 2 {
+		t.Errorf("session-0 count = %d, want 2", got)
+	}
+	if got := testutil.CollectAndCount(l.histograms); got != maxLatencySessions+1 {
+		t.Errorf("got %d histogram series, want %d", got, maxLatencySessions+1)
+	}
+}
+
+func TestLatencyStatsExpire(t *testing.T) {
+	l := newLatencyStats()
+	hops := []hopLatency{{hop: hopEndToEnd, service: "service-c", ms: 10}}
+	l.record("alice", hops)
+	l.record("bob", hops)
+	l.sessions["alice"] = time.Now().Add(-latencySessionIdle)
+
+	l.expire(time.Now())
+	if _, ok := l.sessions["alice"]; ok {
+		t.Error("idle session alice still tracked")
+	}
+	if _, ok := l.bySession[latencyKey{"alice", hopEndToEnd}]; ok {
+		t.Error("idle session alice still has samples")
+	}
+	if _, ok := l.bySession[latencyKey{"bob", hopEndToEnd}]; !ok {
+		t.Error("active session bob lost its samples")
+	}
+	if got := testutil.CollectAndCount(l.histograms); got != 1 {
+		t.Errorf("got %d histogram series, want only bob's", got)
+	}
+	// Services aren't per session; alice's trace still counts there.
+	if got := l.byService[latencyKey{"service-c", hopEndToEnd}].count; got != 2 {
+		t.Errorf("service-c count = %d, want 2", got)
+	}
+}
@@ -18,16 +18,18 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/metalbear-co/playground/internal/health"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"go.opentelemetry.io/otel"
@@ -60,7 +62,14 @@ type Config struct {
 	KafkaAddress string
 	FirstTopic   string
 	TraceTopic   string
+	// TraceConsume is how replicas share the trace topic: "broadcast" (default)
+	// reads every partition on every replica; "group" splits the partitions
+	// between replicas in TraceGroupID.
+	TraceConsume string
 	TraceGroupID string
+	// TraceStartOffset is where a replica starts reading the trace topic:
+	// "end" (default), "start", or a duration to look back, e.g. "15m".
+	TraceStartOffset string
 	// BasePath lets the app be served under a sub-path (e.g. "/kafka-demo") behind
 	// an ingress that does NOT rewrite. Empty = served at root. No trailing slash.
 	BasePath string
@@ -78,6 +87,15 @@ type Config struct {
 	CronOutputTopic string
 	// CronIntervalSecs is how often the running cron inspects DB state.
 	CronIntervalSecs int
+	// TraceStore is where trace events are kept: "memory" (default, per replica),
+	// "postgres" or "redis" (shared by every replica).
+	TraceStore string
+	// TraceTTL is how long a trace is kept after its last event.
+	TraceTTL time.Duration
+	// TraceDatabaseURL is the Postgres trace store. Defaults to DatabaseURL.
+	TraceDatabaseURL string
+	// RedisAddress is the Redis trace store.
+	RedisAddress string
 }
 
 func loadConfig() Config {
@@ -86,63 +104,85 @@ func loadConfig() Config {
 	viper.SetDefault("KAFKA_ADDRESS", "kafka.infra.svc.cluster.local:9092")
 	viper.SetDefault("FIRST_TOPIC", "kafka-demo.a")
 	viper.SetDefault("TRACE_TOPIC", "kafka-demo.trace")
+	viper.SetDefault("TRACE_CONSUME", traceConsumeBroadcast)
 	viper.SetDefault("TRACE_GROUP_ID", "kafka-demo-gateway")
+	viper.SetDefault("TRACE_START_OFFSET", "end")
 	viper.SetDefault("BASE_PATH", "")
 	viper.SetDefault("UI_VARIANT", "")
 	viper.SetDefault("CRON_ENABLED", false)
 	viper.SetDefault("DATABASE_URL", "")
 	viper.SetDefault("CRON_OUTPUT_TOPIC", "kafka-demo.ev.c")
 	viper.SetDefault("CRON_INTERVAL_SECS", 15)
+	viper.SetDefault("TRACE_STORE", traceStoreMemory)
+	viper.SetDefault("TRACE_TTL", "24h")
+	viper.SetDefault("TRACE_DATABASE_URL", "")
+	viper.SetDefault("REDIS_ADDRESS", "")
+
+	traceDatabaseURL := viper.GetString("TRACE_DATABASE_URL")
+	if traceDatabaseURL == "" {
+		traceDatabaseURL = viper.GetString("DATABASE_URL")
+	}
 
 	return Config{
 		Port:             viper.GetString("PORT"),
 		KafkaAddress:     viper.GetString("KAFKA_ADDRESS"),
 		FirstTopic:       viper.GetString("FIRST_TOPIC"),
 		TraceTopic:       viper.GetString("TRACE_TOPIC"),
+		TraceConsume:     viper.GetString("TRACE_CONSUME"),
 		TraceGroupID:     viper.GetString("TRACE_GROUP_ID"),
+		TraceStartOffset: viper.GetString("TRACE_START_OFFSET"),
 		BasePath:         strings.TrimSuffix(viper.GetString("BASE_PATH"), "/"),
 		UIVariant:        viper.GetString("UI_VARIANT"),
 		CronEnabled:      viper.GetBool("CRON_ENABLED"),
 		DatabaseURL:      viper.GetString("DATABASE_URL"),
 		CronOutputTopic:  viper.GetString("CRON_OUTPUT_TOPIC"),
 		CronIntervalSecs: viper.GetInt("CRON_INTERVAL_SECS"),
+		TraceStore:       viper.GetString("TRACE_STORE"),
+		TraceTTL:         viper.GetDuration("TRACE_TTL"),
+		TraceDatabaseURL: traceDatabaseURL,
+		RedisAddress:     viper.GetString("REDIS_ADDRESS"),
 	}
 }
 
-// traceStore keeps the last events per traceId in memory so the UI can poll them.
-type traceStore struct {
-	mu     sync.Mutex
-	events map[string][]TraceEvent
-	order  []string // traceIds, oldest first, for capped eviction
-}
-
-const maxTraces = 200
-
-func newTraceStore() *traceStore {
-	return &traceStore{events: make(map[string][]TraceEvent)}
-}
+// Trace topic consumption modes, selected with TRACE_CONSUME.
+const (
+	traceConsumeBroadcast = "broadcast"
+	traceConsumeGroup     = "group"
+)
 
-func (s *traceStore) add(ev TraceEvent) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if _, ok := s.events[ev.TraceID]; !ok {
-		s.order = append(s.order, ev.TraceID)
-		for len(s.order) > maxTraces {
-			oldest := s.order[0]
-			s.order = s.order[1:]
-			delete(s.events, oldest)
+// traceConsumeOpts returns the client options for consuming the trace topic.
+// A consumer group hands each replica only some partitions, so /trace/:id and
+// the streams would be incomplete on all but one replica with the memory
+// store; broadcast has every replica read every partition itself instead.
+func traceConsumeOpts(cfg Config) ([]kgo.Opt, error) {
+	var start kgo.Offset
+	switch cfg.TraceStartOffset {
+	case "", "end":
+		start = kgo.NewOffset().AtEnd()
+	case "start":
+		start = kgo.NewOffset().AtStart()
+	default:
+		lookback, err := time.ParseDuration(cfg.TraceStartOffset)
+		if err != nil {
+			return nil, fmt.Errorf("TRACE_START_OFFSET: want end, start or a duration: %w", err)
 		}
+		start = kgo.NewOffset().AfterMilli(time.Now().Add(-lookback).UnixMilli())
+	}
+	opts := []kgo.Opt{
+		kgo.ConsumeTopics(cfg.TraceTopic),
+		kgo.ConsumeResetOffset(start),
+	}
+	switch cfg.TraceConsume {
+	case "", traceConsumeBroadcast:
+		return opts, nil
+	case traceConsumeGroup:
+		return append(opts,
+			kgo.ConsumerGroup(cfg.TraceGroupID),
+			kgo.Balancers(kgo.RangeBalancer()),
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown TRACE_CONSUME %q", cfg.TraceConsume)
 	}
-	s.events[ev.TraceID] = append(s.events[ev.TraceID], ev)
-}
-
-func (s *traceStore) get(traceID string) []TraceEvent {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	out := make([]TraceEvent, len(s.events[traceID]))
-	copy(out, s.events[traceID])
-	sort.SliceStable(out, func(i, j int) bool { return out[i].TS < out[j].TS })
-	return out
 }
 
 func newTraceID() string {
@@ -154,23 +194,52 @@ func newTraceID() string {
 func main() {
 	cfg := loadConfig()
 	initPropagator()
-	store := newTraceStore()
+
+	backend, err := newTraceBackend(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("trace store: %v", err)
+	}
+	defer backend.close()
+	store := newTraceStore(backend)
+	log.Printf("trace store: %s (ttl=%s)", cfg.TraceStore, cfg.TraceTTL)
 
 	// One franz-go client: produces to the first topic AND consumes the trace topic.
-	cl, err := kgo.NewClient(
-		kgo.SeedBrokers(cfg.KafkaAddress),
-		kgo.ConsumerGroup(cfg.TraceGroupID),
-		kgo.ConsumeTopics(cfg.TraceTopic),
-		kgo.Balancers(kgo.RangeBalancer()),
-		kgo.ConsumeResetOffset(kgo.NewOffset().AtEnd()),
-	)
+	consumeOpts, err := traceConsumeOpts(cfg)
+	if err != nil {
+		log.Fatalf("trace consumer: %v", err)
+	}
+	cl, err := kgo.NewClient(append([]kgo.Opt{kgo.SeedBrokers(cfg.KafkaAddress)}, consumeOpts...)...)
 	if err != nil {
 		log.Fatalf("kafka client: %v", err)
 	}
 	defer cl.Close()
+	log.Printf("trace consumer: %s from %s", cfg.TraceConsume, cfg.TraceStartOffset)
+
+	// In broadcast mode the other replicas only see what is on the trace topic,
+	// so the events the gateway records itself go there too. Each replica then
+	// records them once more; the store drops the duplicate.
+	if cfg.TraceConsume != traceConsumeGroup {
+		store.forward = func(ev TraceEvent) {
+			body, _ := json.Marshal(ev)
+			rec := &kgo.Record{Topic: cfg.TraceTopic, Value: body,
+				Headers: []kgo.RecordHeader{{Key: "traceId", Value: []byte(ev.TraceID)}}}
+			cl.Produce(context.Background(), rec, func(_ *kgo.Record, err error) {
+				if err != nil {
+					log.Printf("trace forward error: %v", err)
+				}
+			})
+		}
+	}
 
 	// Background consumer of the trace topic. Everything services emit lands here.
-	go consumeTrace(cl, store)
+	go consumeTrace(cl, store, cfg.TraceTopic)
+	health.AddCheck("kafka", cl.Ping)
+	health.AddConsumer(cfg.TraceTopic)
+
+	// Hop latencies of every trace that completes, for /stats and /metrics.
+	latency := newLatencyStats()
+	prometheus.MustRegister(latency.histograms)
+	go latency.follow(context.Background(), store)
 
 	// Optional: in-gateway, UI-controllable CronJob Z for the interactive demo.
 	var cron *cronRunner
@@ -180,6 +249,7 @@ func main() {
 			log.Fatalf("cron: connect Postgres: %v", err)
 		}
 		defer pool.Close()
+		health.AddCheck("postgres", pool.Ping)
 		if err := ensureEventsTable(context.Background(), pool); err != nil {
 			log.Fatalf("cron: ensure events table: %v", err)
 		}
@@ -191,9 +261,12 @@ func main() {
 	router := gin.Default()
 	router.Use(cors.Default())
 
-	// Health stays at the root so k8s probes and the GCE load-balancer health
-	// check reach it regardless of BasePath.
+	// Health and metrics stay at the root so k8s probes, Prometheus and the GCE
+	// load-balancer health check reach them regardless of BasePath.
 	router.GET("/health", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/livez", gin.WrapF(health.Livez))
+	router.GET("/readyz", gin.WrapF(health.Readyz))
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	// All app routes live under BasePath (e.g. "/kafka-demo"); empty = root. The
 	// ingress forwards the full path (no rewrite), so the routes carry the prefix.
@@ -260,7 +333,7 @@ func main() {
 		}
 
 		// Record the kickoff so the UI has something immediately.
-		store.add(TraceEvent{
+		store.emit(TraceEvent{
 			TraceID: traceID, Stage: "gateway", Service: "gateway",
 			Session: session, Message: "produced to " + cfg.FirstTopic,
 			TS: time.Now().UnixMilli(),
@@ -269,10 +342,22 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"traceId": traceID})
 	})
 
-	// GET /trace/:id -> [TraceEvent] — the UI polls this.
+	// GET /trace/:id -> [TraceEvent] — the UI falls back to polling this.
 	app.GET("/trace/:id", func(c *gin.Context) {
-		c.JSON(http.StatusOK, store.get(c.Param("id")))
+		events, err := store.get(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, events)
 	})
+	// GET /traces?session=&stage=&service=&status=&from=&to=&offset=&limit= -> summaries.
+	app.GET("/traces", listTraces(store))
+	// GET /stats -> hop latency percentiles per session and per service.
+	app.GET("/stats", latency.getStats)
+	// GET /trace/:id/stream and GET /events?session= push the same events as SSE.
+	app.GET("/trace/:id/stream", streamTrace(store, store.feed))
+	app.GET("/events", streamSession(store.feed))
 
 	// CronJob Z control + DB-state, for the interactive event-driven demo. Only wired
 	// up when CRON_ENABLED=true; otherwise the UI hides these controls.
@@ -351,7 +436,7 @@ func main() {
 	}
 }
 
-func consumeTrace(cl *kgo.Client, store *traceStore) {
+func consumeTrace(cl *kgo.Client, store *traceStore, topic string) {
 	for {
 		fetches := cl.PollFetches(context.Background())
 		if errs := fetches.Errors(); len(errs) > 0 {
@@ -361,6 +446,7 @@ func consumeTrace(cl *kgo.Client, store *traceStore) {
 			time.Sleep(time.Second)
 			continue
 		}
+		health.Polled(topic)
 		fetches.EachRecord(func(rec *kgo.Record) {
 			var ev TraceEvent
 			if err := json.Unmarshal(rec.Value, &ev); err != nil {
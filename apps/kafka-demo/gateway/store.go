@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/metalbear-co/playground/internal/health"
+)
+
+// Trace store backends, selected with TRACE_STORE. memory is per replica and
+// lost on restart; postgres and redis are shared, so any replica can answer
+// /trace/:id for a trace another one recorded.
+const (
+	traceStoreMemory   = "memory"
+	traceStorePostgres = "postgres"
+	traceStoreRedis    = "redis"
+)
+
+// traceStoreTimeout bounds every backend call, so a slow store can't stall
+// the trace consumer.
+const traceStoreTimeout = 5 * time.Second
+
+// traceBackend keeps trace events until ttl after a trace's last event.
+// Adding an event it already has (same eventKey) is a no-op that reports false:
+// in broadcast mode every replica records every event into a shared backend.
+type traceBackend interface {
+	add(ctx context.Context, ev TraceEvent) (bool, error)
+	// get returns the trace's events, in no particular order.
+	get(ctx context.Context, traceID string) ([]TraceEvent, error)
+	// recent returns every event of the traces whose first event is between
+	// from and to (unix millis), in no particular order.
+	recent(ctx context.Context, from, to int64) ([]TraceEvent, error)
+	close()
+}
+
+// newTraceBackend opens the backend cfg.TraceStore selects, and registers its
+// readiness check.
+func newTraceBackend(ctx context.Context, cfg Config) (traceBackend, error) {
+	switch cfg.TraceStore {
+	case "", traceStoreMemory:
+		return newMemoryTraces(cfg.TraceTTL), nil
+	case traceStorePostgres:
+		if cfg.TraceDatabaseURL == "" {
+			return nil, fmt.Errorf("TRACE_STORE=postgres needs TRACE_DATABASE_URL or DATABASE_URL")
+		}
+		backend, err := newPostgresTraces(ctx, cfg.TraceDatabaseURL, cfg.TraceTTL)
+		if err != nil {
+			return nil, err
+		}
+		health.AddCheck("trace-store", backend.pool.Ping)
+		return backend, nil
+	case traceStoreRedis:
+		backend, err := newRedisTraces(ctx, cfg.RedisAddress, cfg.TraceTTL)
+		if err != nil {
+			return nil, err
+		}
+		health.AddCheck("trace-store", func(ctx context.Context) error { return backend.client.Ping(ctx).Err() })
+		return backend, nil
+	default:
+		return nil, fmt.Errorf("unknown trace store %q", cfg.TraceStore)
+	}
+}
+
+// eventKey identifies a trace event, for deduplication.
+func eventKey(ev TraceEvent) string {
+	return ev.TraceID + "|" + ev.Stage + "|" + ev.Message + "|" + strconv.FormatInt(ev.TS, 10)
+}
+
+// publishedEvents is how many recent event keys a replica remembers to
+// publish each event to its streams only once.
+const publishedEvents = maxTraces * 50
+
+// recentKeys remembers the last keys it was given, in two generations so
+// rolling over doesn't forget the newest ones.
+type recentKeys struct {
+	mu        sync.Mutex
+	size      int
+	cur, prev map[string]struct{}
+}
+
+func newRecentKeys(size int) *recentKeys {
+	return &recentKeys{size: size, cur: make(map[string]struct{}), prev: make(map[string]struct{})}
+}
+
+// add remembers key and reports whether it was new.
+func (r *recentKeys) add(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cur[key]; ok {
+		return false
+	}
+	if _, ok := r.prev[key]; ok {
+		return false
+	}
+	if len(r.cur) >= r.size {
+		r.prev, r.cur = r.cur, make(map[string]struct{})
+	}
+	r.cur[key] = struct{}{}
+	return true
+}
+
+// traceStore records trace events in a traceBackend so the UI can fetch them,
+// and passes every new event on to the open streams.
+type traceStore struct {
+	backend traceBackend
+	feed    *traceFeed
+	// published dedupes the feed for events a shared backend already had
+	// from another replica.
+	published *recentKeys
+	// forward, when set, shares the events the gateway itself originates
+	// (kickoff, CronJob Z) with the other replicas via the trace topic.
+	forward func(TraceEvent)
+}
+
+func newTraceStore(backend traceBackend) *traceStore {
+	return &traceStore{backend: backend, feed: newTraceFeed(), published: newRecentKeys(publishedEvents)}
+}
+
+// add records ev and publishes it, unless this replica already has. The
+// gateway re-consumes the events it emits, and in broadcast mode a shared
+// backend usually has the event from the first replica that got it.
+func (s *traceStore) add(ev TraceEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), traceStoreTimeout)
+	defer cancel()
+	added, err := s.backend.add(ctx, ev)
+	if err != nil {
+		// Streams still get it; only a later GET /trace/:id misses it.
+		log.Printf("trace store: add %s: %v", ev.TraceID, err)
+	}
+	if unpublished := s.published.add(eventKey(ev)); added || unpublished {
+		s.feed.publish(ev)
+	}
+}
+
+// emit records an event the gateway originated, and forwards it if set.
+func (s *traceStore) emit(ev TraceEvent) {
+	s.add(ev)
+	if s.forward != nil {
+		s.forward(ev)
+	}
+}
+
+func (s *traceStore) get(ctx context.Context, traceID string) ([]TraceEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, traceStoreTimeout)
+	defer cancel()
+	out, err := s.backend.get(ctx, traceID)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].TS < out[j].TS })
+	return out, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxTraces caps the memory backend, whatever the TTL.
+const maxTraces = 200
+
+// memoryTraces keeps the last traces in a map, for a single gateway replica.
+type memoryTraces struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	events   map[string][]TraceEvent
+	order    []string // traceIds, oldest first, for capped eviction
+	lastSeen map[string]time.Time
+}
+
+func newMemoryTraces(ttl time.Duration) *memoryTraces {
+	return &memoryTraces{
+		ttl:      ttl,
+		events:   make(map[string][]TraceEvent),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+func (m *memoryTraces) add(_ context.Context, ev TraceEvent) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	if _, ok := m.events[ev.TraceID]; !ok {
+		m.order = append(m.order, ev.TraceID)
+		for len(m.order) > maxTraces {
+			m.drop()
+		}
+	}
+	key := eventKey(ev)
+	for _, have := range m.events[ev.TraceID] {
+		if eventKey(have) == key {
+			return false, nil
+		}
+	}
+	m.events[ev.TraceID] = append(m.events[ev.TraceID], ev)
+	m.lastSeen[ev.TraceID] = time.Now()
+	return true, nil
+}
+
+func (m *memoryTraces) get(_ context.Context, traceID string) ([]TraceEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	out := make([]TraceEvent, len(m.events[traceID]))
+	copy(out, m.events[traceID])
+	return out, nil
+}
+
+func (m *memoryTraces) recent(_ context.Context, from, to int64) ([]TraceEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	out := []TraceEvent{}
+	for _, events := range m.events {
+		start := events[0].TS
+		for _, ev := range events {
+			if ev.TS < start {
+				start = ev.TS
+			}
+		}
+		if start >= from && start <= to {
+			out = append(out, events...)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryTraces) close() {}
+
+// expire drops traces whose last event is older than ttl. order is by first
+// event, so it stops at the first trace still live; one that outlives a later
+// expired trace just holds it a little longer.
+func (m *memoryTraces) expire() {
+	cutoff := time.Now().Add(-m.ttl)
+	for len(m.order) > 0 && m.lastSeen[m.order[0]].Before(cutoff) {
+		m.drop()
+	}
+}
+
+// drop removes the oldest trace.
+func (m *memoryTraces) drop() {
+	oldest := m.order[0]
+	m.order = m.order[1:]
+	delete(m.events, oldest)
+	delete(m.lastSeen, oldest)
+}
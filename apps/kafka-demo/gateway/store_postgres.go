@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// tracePruneInterval is how often the postgres backend deletes expired traces.
+const tracePruneInterval = time.Minute
+
+// postgresTraces keeps trace events in kafka_demo_trace_events, shared by every
+// gateway replica. Expired traces are deleted in the background.
+type postgresTraces struct {
+	pool *pgxpool.Pool
+	ttl  time.Duration
+	stop context.CancelFunc
+}
+
+func newPostgresTraces(ctx context.Context, url string, ttl time.Duration) (*postgresTraces, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS kafka_demo_trace_events (
+		id bigserial PRIMARY KEY,
+		trace_id text NOT NULL,
+		stage text NOT NULL DEFAULT '',
+		service text NOT NULL DEFAULT '',
+		session text NOT NULL DEFAULT '',
+		message text NOT NULL DEFAULT '',
+		done boolean NOT NULL DEFAULT false,
+		ts bigint NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, `CREATE INDEX IF NOT EXISTS kafka_demo_trace_events_trace_id ON kafka_demo_trace_events (trace_id)`); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, `CREATE INDEX IF NOT EXISTS kafka_demo_trace_events_ts ON kafka_demo_trace_events (ts)`); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	// Every replica records every event in broadcast mode; keep one row each.
+	if _, err := pool.Exec(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS kafka_demo_trace_events_event ON kafka_demo_trace_events (trace_id, stage, message, ts)`); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	pruneCtx, stop := context.WithCancel(context.Background())
+	p := &postgresTraces{pool: pool, ttl: ttl, stop: stop}
+	go p.pruneLoop(pruneCtx)
+	return p, nil
+}
+
+func (p *postgresTraces) add(ctx context.Context, ev TraceEvent) (bool, error) {
+	tag, err := p.pool.Exec(ctx, `
+		INSERT INTO kafka_demo_trace_events (trace_id, stage, service, session, message, done, ts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (trace_id, stage, message, ts) DO NOTHING`,
+		ev.TraceID, ev.Stage, ev.Service, ev.Session, ev.Message, ev.Done, ev.TS)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (p *postgresTraces) get(ctx context.Context, traceID string) ([]TraceEvent, error) {
+	rows, err := p.pool.Query(ctx, `
+		SELECT trace_id, stage, service, session, message, done, ts
+		FROM kafka_demo_trace_events
+		WHERE trace_id = $1
+		ORDER BY id`, traceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []TraceEvent{}
+	for rows.Next() {
+		var ev TraceEvent
+		if err := rows.Scan(&ev.TraceID, &ev.Stage, &ev.Service, &ev.Session, &ev.Message, &ev.Done, &ev.TS); err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+func (p *postgresTraces) recent(ctx context.Context, from, to int64) ([]TraceEvent, error) {
+	rows, err := p.pool.Query(ctx, `
+		SELECT trace_id, stage, service, session, message, done, ts
+		FROM kafka_demo_trace_events
+		WHERE trace_id IN (
+			SELECT trace_id FROM kafka_demo_trace_events
+			WHERE ts <= $2
+			GROUP BY trace_id
+			HAVING min(ts) BETWEEN $1 AND $2
+		)`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []TraceEvent{}
+	for rows.Next() {
+		var ev TraceEvent
+		if err := rows.Scan(&ev.TraceID, &ev.Stage, &ev.Service, &ev.Session, &ev.Message, &ev.Done, &ev.TS); err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+func (p *postgresTraces) close() {
+	p.stop()
+	p.pool.Close()
+}
+
+func (p *postgresTraces) pruneLoop(ctx context.Context) {
+	t := time.NewTicker(tracePruneInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := p.prune(ctx); err != nil {
+				log.Printf("trace store: prune: %v", err)
+			}
+		}
+	}
+}
+
+// prune deletes the traces whose last event is older than ttl, whole traces
+// at a time.
+func (p *postgresTraces) prune(ctx context.Context) error {
+	_, err := p.pool.Exec(ctx, `
+		DELETE FROM kafka_demo_trace_events WHERE trace_id IN (
+			SELECT trace_id FROM kafka_demo_trace_events
+			GROUP BY trace_id
+			HAVING max(created_at) < now() - make_interval(secs => $1)
+		)`, p.ttl.Seconds())
+	return err
+}
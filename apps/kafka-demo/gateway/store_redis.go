@@ -0,0 +1,120 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisTraceKeyPrefix = "kafka-demo-trace-events-"
+	// redisTraceIndexKey is a sorted set of traceIds by last event TS, for
+	// listing. Entries are dropped once their trace has expired, or its last
+	// event is more than ttl ago, which is when its hash expires too.
+	redisTraceIndexKey = "kafka-demo-trace-index"
+)
+
+// redisTraces keeps each trace as a hash of JSON events by eventKey, shared by
+// every gateway replica. Every event pushes the trace's expiry out to ttl.
+type redisTraces struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisTraces(ctx context.Context, address string, ttl time.Duration) (*redisTraces, error) {
+	client := redis.NewClient(&redis.Options{Addr: address})
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisTraces{client: client, ttl: ttl}, nil
+}
+
+func (r *redisTraces) add(ctx context.Context, ev TraceEvent) (bool, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return false, err
+	}
+	key := redisTraceKeyPrefix + ev.TraceID
+	pipe := r.client.TxPipeline()
+	added := pipe.HSetNX(ctx, key, eventKey(ev), body)
+	pipe.Expire(ctx, key, r.ttl)
+	pipe.ZAddGT(ctx, redisTraceIndexKey, redis.Z{Score: float64(ev.TS), Member: ev.TraceID})
+	// Keep the index from growing without listings: a trace whose last event
+	// is more than ttl old has all but certainly expired.
+	pipe.ZRemRangeByScore(ctx, redisTraceIndexKey, "-inf", "("+strconv.FormatInt(time.Now().Add(-r.ttl).UnixMilli(), 10))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return added.Val(), nil
+}
+
+func (r *redisTraces) get(ctx context.Context, traceID string) ([]TraceEvent, error) {
+	values, err := r.client.HVals(ctx, redisTraceKeyPrefix+traceID).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]TraceEvent, 0, len(values))
+	for _, value := range values {
+		var ev TraceEvent
+		if err := json.Unmarshal([]byte(value), &ev); err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, nil
+}
+
+// recent loads the traces whose last event is after from, since the index
+// only has that, and keeps the ones whose first event is also before to.
+func (r *redisTraces) recent(ctx context.Context, from, to int64) ([]TraceEvent, error) {
+	traceIDs, err := r.client.ZRangeByScore(ctx, redisTraceIndexKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(from, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(traceIDs))
+	for i, traceID := range traceIDs {
+		cmds[i] = pipe.HVals(ctx, redisTraceKeyPrefix+traceID)
+	}
+	if len(traceIDs) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	out := []TraceEvent{}
+	var expired []interface{}
+	for i, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			expired = append(expired, traceIDs[i])
+			continue
+		}
+		events := make([]TraceEvent, len(cmd.Val()))
+		for j, value := range cmd.Val() {
+			if err := json.Unmarshal([]byte(value), &events[j]); err != nil {
+				return nil, err
+			}
+		}
+		first := slices.MinFunc(events, func(a, b TraceEvent) int { return cmp.Compare(a.TS, b.TS) })
+		if first.TS >= from && first.TS <= to {
+			out = append(out, events...)
+		}
+	}
+	if len(expired) > 0 {
+		r.client.ZRem(ctx, redisTraceIndexKey, expired...)
+	}
+	return out, nil
+}
+
+func (r *redisTraces) close() {
+	r.client.Close()
+}
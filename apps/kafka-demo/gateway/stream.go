@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server-Sent Events for the UI, so it doesn't have to poll GET /trace/:id.
+// Every event the gateway records (from the trace topic, the produce handler
+// or the in-gateway cron) is fanned out to the open streams that want it.
+
+const (
+	// streamBuffer is how many events a slow stream may lag behind before
+	// further events are dropped for it.
+	streamBuffer = 64
+	// streamHeartbeat keeps idle streams open through proxies and load balancers.
+	streamHeartbeat = 15 * time.Second
+)
+
+// traceFeed fans recorded trace events out to SSE subscribers.
+type traceFeed struct {
+	mu          sync.Mutex
+	subscribers map[chan TraceEvent]func(TraceEvent) bool
+}
+
+func newTraceFeed() *traceFeed {
+	return &traceFeed{subscribers: make(map[chan TraceEvent]func(TraceEvent) bool)}
+}
+
+func (f *traceFeed) publish(ev TraceEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch, match := range f.subscribers {
+		if !match(ev) {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			// Never let one stalled browser hold up the consumer or other streams.
+		}
+	}
+}
+
+// subscribe registers a stream for the events match accepts; the returned
+// func unregisters it.
+func (f *traceFeed) subscribe(match func(TraceEvent) bool) (<-chan TraceEvent, func()) {
+	ch := make(chan TraceEvent, streamBuffer)
+	f.mu.Lock()
+	f.subscribers[ch] = match
+	f.mu.Unlock()
+	return ch, func() {
+		f.mu.Lock()
+		delete(f.subscribers, ch)
+		f.mu.Unlock()
+	}
+}
+
+// serveEvents streams events as SSE "trace" events, after the backlog, until
+// one with Done is sent or the client goes away. Heartbeats go out every
+// streamHeartbeat.
+func serveEvents(c *gin.Context, events <-chan TraceEvent, backlog []TraceEvent) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	// Send headers right away so the browser's EventSource opens before the first event.
+	c.Writer.Flush()
+
+	// An event can be both in the backlog and on the channel; send it once.
+	seen := make(map[string]bool)
+	send := func(ev TraceEvent) bool {
+		key := eventKey(ev)
+		if !seen[key] {
+			seen[key] = true
+			c.SSEvent("trace", ev)
+		}
+		return !ev.Done
+	}
+	for _, ev := range backlog {
+		if !send(ev) {
+			c.Writer.Flush()
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			c.SSEvent("heartbeat", gin.H{"ts": time.Now().UnixMilli()})
+			return true
+		case ev := <-events:
+			return send(ev)
+		}
+	})
+}
+
+// streamTrace serves GET /trace/:id/stream: the trace's events so far, then
+// each new one as it arrives, closing after the Done event.
+func streamTrace(store *traceStore, feed *traceFeed) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		traceID := c.Param("id")
+		// Subscribe before reading the backlog so nothing falls in between.
+		events, unsubscribe := feed.subscribe(func(ev TraceEvent) bool { return ev.TraceID == traceID })
+		defer unsubscribe()
+		backlog, err := store.get(c.Request.Context(), traceID)
+		if err != nil {
+			log.Printf("trace store: get %s: %v", traceID, err)
+		}
+		serveEvents(c, events, backlog)
+	}
+}
+
+// streamSession serves GET /events?session=: every event of the session's
+// messages as it arrives, closing after the first Done event. Without
+// ?session= it follows messages sent without one.
+func streamSession(feed *traceFeed) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := c.Query("session")
+		events, unsubscribe := feed.subscribe(func(ev TraceEvent) bool { return ev.Session == session })
+		defer unsubscribe()
+		serveEvents(c, events, nil)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /traces: find traces without knowing their traceId, e.g. "what did
+// session alice send in the last five minutes".
+
+const (
+	defaultTracesLimit = 50
+	maxTracesLimit     = 500
+	// defaultTracesWindow is how far back ?from= looks when unset. Every
+	// trace in the window is loaded to filter it, so it is kept short.
+	defaultTracesWindow = time.Hour
+)
+
+// Trace completion statuses for ?status=.
+const (
+	traceCompleted  = "completed"
+	traceInProgress = "in-progress"
+)
+
+// TraceSummary is one trace in GET /traces, computed from its events.
+type TraceSummary struct {
+	TraceID   string   `json:"traceId"`
+	Session   string   `json:"session"`
+	Stages    []string `json:"stages"`   // stages reached, in order
+	Services  []string `json:"services"` // services seen, in order
+	LastStage string   `json:"lastStage"`
+	Completed bool     `json:"completed"`
+	Events    int      `json:"events"`
+	StartTS   int64    `json:"startTs"`
+	EndTS     int64    `json:"endTs"`
+	// DurationMs is from the first event to the last one so far.
+	DurationMs int64 `json:"durationMs"`
+}
+
+// summarize builds the summary of one trace's events, sorted by TS.
+func summarize(events []TraceEvent) TraceSummary {
+	first, last := events[0], events[len(events)-1]
+	s := TraceSummary{
+		TraceID:    first.TraceID,
+		Session:    first.Session,
+		LastStage:  last.Stage,
+		Events:     len(events),
+		StartTS:    first.TS,
+		EndTS:      last.TS,
+		DurationMs: last.TS - first.TS,
+	}
+	for _, ev := range events {
+		if !slices.Contains(s.Stages, ev.Stage) {
+			s.Stages = append(s.Stages, ev.Stage)
+		}
+		if !slices.Contains(s.Services, ev.Service) {
+			s.Services = append(s.Services, ev.Service)
+		}
+		if ev.Done {
+			s.Completed = true
+		}
+	}
+	return s
+}
+
+// traceQuery filters GET /traces. Empty fields match everything.
+type traceQuery struct {
+	// Session matches exactly when set; "" selects production traces.
+	Session *string
+	Stage   string // reached this stage
+	Service string // has an event from this service
+	Status  string // traceCompleted or traceInProgress
+	// From and To bound the trace's first event, in unix millis.
+	From, To int64
+	Offset   int
+	Limit    int
+}
+
+func (q traceQuery) match(s TraceSummary) bool {
+	switch {
+	case q.Session != nil && s.Session != *q.Session:
+		return false
+	case q.Stage != "" && !slices.Contains(s.Stages, q.Stage):
+		return false
+	case q.Service != "" && !slices.Contains(s.Services, q.Service):
+		return false
+	case q.Status == traceCompleted && !s.Completed:
+		return false
+	case q.Status == traceInProgress && s.Completed:
+		return false
+	}
+	return true
+}
+
+// list returns the page of matching traces, newest first, and how many match
+// in total.
+func (s *traceStore) list(ctx context.Context, q traceQuery) ([]TraceSummary, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, traceStoreTimeout)
+	defer cancel()
+	events, err := s.backend.recent(ctx, q.From, q.To)
+	if err != nil {
+		return nil, 0, err
+	}
+	byTrace := make(map[string][]TraceEvent)
+	for _, ev := range events {
+		byTrace[ev.TraceID] = append(byTrace[ev.TraceID], ev)
+	}
+	matched := []TraceSummary{}
+	for _, trace := range byTrace {
+		sort.SliceStable(trace, func(i, j int) bool { return trace[i].TS < trace[j].TS })
+		if summary := summarize(trace); q.match(summary) {
+			matched = append(matched, summary)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].StartTS != matched[j].StartTS {
+			return matched[i].StartTS > matched[j].StartTS
+		}
+		return matched[i].TraceID < matched[j].TraceID
+	})
+	total := len(matched)
+	if q.Offset >= total {
+		return []TraceSummary{}, total, nil
+	}
+	end := q.Offset + q.Limit
+	if end > total {
+		end = total
+	}
+	return matched[q.Offset:end], total, nil
+}
+
+// parseTraceTime reads ?from= and ?to=: an RFC 3339 time, unix millis, or a
+// duration ago such as "5m".
+func parseTraceTime(value string) (int64, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UnixMilli(), nil
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ms, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-ago).UnixMilli(), nil
+	}
+	return 0, fmt.Errorf("want an RFC 3339 time, unix millis or a duration ago, got %q", value)
+}
+
+// parseTraceQuery reads GET /traces?session=&stage=&service=&status=&from=&to=&offset=&limit=.
+func parseTraceQuery(c *gin.Context) (traceQuery, error) {
+	q := traceQuery{
+		Stage:   c.Query("stage"),
+		Service: c.Query("service"),
+		Status:  c.Query("status"),
+		To:      time.Now().UnixMilli(),
+	}
+	if session, ok := c.GetQuery("session"); ok {
+		q.Session = &session
+	}
+	switch q.Status {
+	case "", traceCompleted, traceInProgress:
+	default:
+		return q, fmt.Errorf("status must be completed or in-progress")
+	}
+	var err error
+	if to := c.Query("to"); to != "" {
+		if q.To, err = parseTraceTime(to); err != nil {
+			return q, fmt.Errorf("to: %w", err)
+		}
+	}
+	q.From = q.To - defaultTracesWindow.Milliseconds()
+	if from := c.Query("from"); from != "" {
+		if q.From, err = parseTraceTime(from); err != nil {
+			return q, fmt.Errorf("from: %w", err)
+		}
+	}
+	if q.Offset, err = strconv.Atoi(c.DefaultQuery("offset", "0")); err != nil || q.Offset < 0 {
+		return q, fmt.Errorf("offset must be a number >= 0")
+	}
+	if q.Limit, err = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultTracesLimit))); err != nil || q.Limit < 1 || q.Limit > maxTracesLimit {
+		return q, fmt.Errorf("limit must be between 1 and %d", maxTracesLimit)
+	}
+	return q, nil
+}
+
+// listTraces serves GET /traces.
+func listTraces(store *traceStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, err := parseTraceQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		traces, total, err := store.list(c.Request.Context(), q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"traces": traces,
+			"total":  total,
+			"offset": q.Offset,
+			"limit":  q.Limit,
+		})
+	}
+}
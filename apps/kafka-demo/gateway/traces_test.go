@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// chain returns the events of one trace through the Kafka chain, starting at
+// start, that reached the given stages.
+func chain(traceID, session string, start int64, stages ...string) []TraceEvent {
+	services := map[string]string{"gateway": "gateway", "a": "service-a", "b": "service-b", "z": "cronjob-z", "c": "service-c"}
+	var events []TraceEvent
+	for i, stage := range stages {
+		events = append(events, TraceEvent{
+			TraceID: traceID,
+			Stage:   stage,
+			Service: services[stage],
+			Session: session,
+			Message: "hello",
+			Done:    stage == "c",
+			TS:      start + int64(i)*10,
+		})
+	}
+	return events
+}
+
+func TestSummarize(t *testing.T) {
+	events := chain("t1", "alice", 1000, "gateway", "a", "b", "c")
+	// A retry of stage b: counted as an event, not as another stage.
+	events = slices.Insert(events, 3, TraceEvent{TraceID: "t1", Stage: "b", Service: "service-b", Session: "alice", TS: 1025})
+	want := TraceSummary{
+		TraceID:    "t1",
+		Session:    "alice",
+		Stages:     []string{"gateway", "a", "b", "c"},
+		Services:   []string{"gateway", "service-a", "service-b", "service-c"},
+		LastStage:  "c",
+		Completed:  true,
+		Events:     5,
+		StartTS:    1000,
+		EndTS:      1030,
+		DurationMs: 30,
+	}
+	if got := summarize(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("summarize() = %+v, want %+v", got, want)
+	}
+
+	inProgress := summarize(chain("t2", "", 1000, "gateway", "a"))
+	if inProgress.Completed || inProgress.LastStage != "a" || inProgress.DurationMs != 10 {
+		t.Errorf("summarize() = %+v, want an in-progress trace at a", inProgress)
+	}
+}
+
+func TestTraceQueryMatch(t *testing.T) {
+	production, alice := "", "alice"
+	completed := summarize(chain("t1", "alice", 1000, "gateway", "a", "b", "c"))
+	tests := []struct {
+		name  string
+		query traceQuery
+		want  bool
+	}{
+		{name: "empty query", query: traceQuery{}, want: true},
+		{name: "session", query: traceQuery{Session: &alice}, want: true},
+		{name: "production only", query: traceQuery{Session: &production}, want: false},
+		{name: "stage reached", query: traceQuery{Stage: "b"}, want: true},
+		{name: "stage not reached", query: traceQuery{Stage: "z"}, want: false},
+		{name: "service", query: traceQuery{Service: "service-c"}, want: true},
+		{name: "other service", query: traceQuery{Service: "cronjob-z"}, want: false},
+		{name: "completed", query: traceQuery{Status: traceCompleted}, want: true},
+		{name: "in progress", query: traceQuery{Status: traceInProgress}, want: false},
+		{name: "all filters", query: traceQuery{Session: &alice, Stage: "c", Service: "service-a", Status: traceCompleted}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.query.match(completed); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTraceTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "2025-06-01T12:00:00Z", want: time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC).UnixMilli()},
+		{value: "2025-06-01T14:00:00+02:00", want: time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC).UnixMilli()},
+		{value: "1748779200000", want: 1748779200000},
+		{value: "yesterday", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTraceTime(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTraceTime(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTraceTime(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+
+	// A duration is that long ago.
+	before := time.Now().Add(-5 * time.Minute).UnixMilli()
+	got, err := parseTraceTime("5m")
+	after := time.Now().Add(-5 * time.Minute).UnixMilli()
+	if err != nil || got < before || got > after {
+		t.Errorf("parseTraceTime(5m) = %d, %v, want between %d and %d", got, err, before, after)
+	}
+}
+
+func TestParseTraceQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	alice := "alice"
+	production := ""
+	tests := []struct {
+		name    string
+		query   string
+		want    traceQuery // From and To are checked separately when unset
+		wantErr bool
+	}{
+		{name: "defaults", query: "", want: traceQuery{Limit: defaultTracesLimit}},
+		{name: "session", query: "session=alice", want: traceQuery{Session: &alice, Limit: defaultTracesLimit}},
+		{name: "production session", query: "session=", want: traceQuery{Session: &production, Limit: defaultTracesLimit}},
+		{
+			name:  "all filters",
+			query: "stage=b&service=service-b&status=completed&from=1000&to=2000&offset=10&limit=5",
+			want:  traceQuery{Stage: "b", Service: "service-b", Status: traceCompleted, From: 1000, To: 2000, Offset: 10, Limit: 5},
+		},
+		{name: "default window before to", query: "to=5000000", want: traceQuery{To: 5000000, Limit: defaultTracesLimit}},
+		{name: "bad status", query: "status=done", wantErr: true},
+		{name: "bad from", query: "from=yesterday", wantErr: true},
+		{name: "bad to", query: "to=tomorrow", wantErr: true},
+		{name: "negative offset", query: "offset=-1", wantErr: true},
+		{name: "zero limit", query: "limit=0", wantErr: true},
+		{name: "limit too large", query: "limit=501", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/traces?"+tt.query, nil)
+			before := time.Now().UnixMilli()
+			got, err := parseTraceQuery(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTraceQuery() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.want.From == 0 {
+				if want := got.To - defaultTracesWindow.Milliseconds(); got.From != want {
+					t.Errorf("From = %d, want %d (To - defaultTracesWindow)", got.From, want)
+				}
+				got.From = 0
+			}
+			if tt.want.To == 0 {
+				if got.To < before || got.To > time.Now().UnixMilli() {
+					t.Errorf("To = %d, want now", got.To)
+				}
+				got.To = 0
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTraceQuery() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceStoreList(t *testing.T) {
+	store := newTraceStore(newMemoryTraces(time.Hour))
+	var events []TraceEvent
+	events = append(events, chain("t1", "", 1000, "gateway", "a", "b", "c")...)
+	events = append(events, chain("t2", "alice", 2000, "gateway", "a")...)
+	events = append(events, chain("t3", "alice", 3000, "gateway", "a", "b", "z", "c")...)
+	events = append(events, chain("t4", "", 4000, "gateway")...)
+	// Out of order, as they arrive from different partitions.
+	for _, ev := range slices.Backward(events) {
+		store.add(ev)
+	}
+
+	alice := "alice"
+	tests := []struct {
+		name      string
+		query     traceQuery
+		wantIds   []string
+		wantTotal int
+	}{
+		{name: "newest first", query: traceQuery{To: 5000, Limit: 50}, wantIds: []string{"t4", "t3", "t2", "t1"}, wantTotal: 4},
+		{name: "page", query: traceQuery{To: 5000, Offset: 1, Limit: 2}, wantIds: []string{"t3", "t2"}, wantTotal: 4},
+		{name: "offset past the end", query: traceQuery{To: 5000, Offset: 4, Limit: 2}, wantIds: []string{}, wantTotal: 4},
+		{name: "session", query: traceQuery{Session: &alice, To: 5000, Limit: 50}, wantIds: []string{"t3", "t2"}, wantTotal: 2},
+		{name: "completed", query: traceQuery{Status: traceCompleted, To: 5000, Limit: 50}, wantIds: []string{"t3", "t1"}, wantTotal: 2},
+		{name: "through z", query: traceQuery{Stage: "z", To: 5000, Limit: 50}, wantIds: []string{"t3"}, wantTotal: 1},
+		{name: "time window by first event", query: traceQuery{From: 1500, To: 3000, Limit: 50}, wantIds: []string{"t3", "t2"}, wantTotal: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traces, total, err := store.list(context.Background(), tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, trace := range traces {
+				ids = append(ids, trace.TraceID)
+			}
+			if !slices.Equal(ids, tt.wantIds) || total != tt.wantTotal {
+				t.Errorf("list() = %v (total %d), want %v (total %d)", ids, total, tt.wantIds, tt.wantTotal)
+			}
+		})
+	}
+
+	traces, _, _ := store.list(context.Background(), traceQuery{To: 5000, Limit: 50})
+	if first := traces[len(traces)-1]; first.Stages[0] != "gateway" || first.Events != 4 {
+		t.Errorf("t1 = %+v, want its events sorted by TS", first)
+	}
+}
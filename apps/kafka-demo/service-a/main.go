@@ -30,6 +30,7 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/metalbear-co/playground/internal/health"
 	"github.com/spf13/viper"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"go.opentelemetry.io/otel"
@@ -147,10 +148,20 @@ func main() {
 	}
 	defer cl.Close()
 
+	// Readiness follows the broker and, when there is one, the DB. /health.Readyz also
+	// reports how long ago the consume loop last got records.
+	health.AddCheck("kafka", cl.Ping)
+	if dbPool != nil {
+		health.AddCheck("postgres", dbPool.Ping)
+	}
+	health.AddConsumer(cfg.InTopic)
+
 	// Minimal health endpoint so k8s probes and mirrord targeting have a port.
 	go func() {
 		mux := http.NewServeMux()
 		mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+		mux.HandleFunc("/livez", health.Livez)
+		mux.HandleFunc("/readyz", health.Readyz)
 		log.Printf("%s health server on :%s", cfg.ServiceName, cfg.Port)
 		_ = http.ListenAndServe("0.0.0.0:"+cfg.Port, mux)
 	}()
@@ -167,6 +178,7 @@ func main() {
 			time.Sleep(time.Second)
 			continue
 		}
+		health.Polled(cfg.InTopic)
 		fetches.EachRecord(func(rec *kgo.Record) { handleRecord(cfg, cl, dbPool, rec) })
 	}
 }
@@ -0,0 +1,181 @@
+// Package health serves the /livez and /readyz endpoints of the playground
+// services. Services register their own dependencies with AddCheck and their
+// Kafka or SQS readers with AddConsumer, then mount Livez and Readyz.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Every dependency check gets healthCheckTimeout, and a readiness report is
+// reused for healthCacheTTL so frequent probes don't hammer the dependencies.
+const (
+	healthCheckTimeout = 2 * time.Second
+	healthCacheTTL     = 5 * time.Second
+)
+
+// DependencyStatus is one dependency in the /readyz report.
+type DependencyStatus struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"` // "ok" or "down"
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ConsumerStatus is one Kafka consumer in the /readyz report. The poll fields
+// are null until its first successful poll.
+type ConsumerStatus struct {
+	Name            string     `json:"name"`
+	LastPoll        *time.Time `json:"last_poll"`
+	SinceLastPollMs *int64     `json:"since_last_poll_ms"`
+}
+
+// ReadinessReport is the body of /readyz.
+type ReadinessReport struct {
+	Status       string             `json:"status"` // "ok" or "unavailable"
+	CheckedAt    time.Time          `json:"checked_at"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+	Consumers    []ConsumerStatus   `json:"consumers,omitempty"`
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Health holds the dependency checks behind /readyz and the last poll of each
+// Kafka consumer.
+type Health struct {
+	mu        sync.Mutex
+	checks    []healthCheck
+	consumers []string
+	polls     map[string]time.Time
+
+	// running serializes check runs, so concurrent probes share one.
+	running sync.Mutex
+	cached  *ReadinessReport
+}
+
+// New returns a Health without checks or consumers.
+func New() *Health {
+	return &Health{polls: map[string]time.Time{}}
+}
+
+// Default is the Health behind the package-level functions and handlers.
+var Default = New()
+
+// AddCheck registers a dependency with Default.
+func AddCheck(name string, check func(ctx context.Context) error) { Default.AddCheck(name, check) }
+
+// AddConsumer registers a consumer with Default.
+func AddConsumer(name string) { Default.AddConsumer(name) }
+
+// Polled records a successful poll of the named consumer with Default.
+func Polled(name string) { Default.Polled(name) }
+
+// AddCheck registers a dependency; check returns nil while it is usable.
+func (h *Health) AddCheck(name string, check func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, healthCheck{name: name, check: check})
+}
+
+// AddConsumer registers a Kafka consumer whose polls are reported.
+func (h *Health) AddConsumer(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.consumers = append(h.consumers, name)
+}
+
+// Polled records a successful poll of the named consumer.
+func (h *Health) Polled(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.polls[name] = time.Now()
+}
+
+// Report runs the checks, or reuses the last run while it is fresh. Consumer
+// polls are always current.
+func (h *Health) Report() ReadinessReport {
+	h.running.Lock()
+	if h.cached == nil || time.Since(h.cached.CheckedAt) >= healthCacheTTL {
+		h.mu.Lock()
+		checks := h.checks
+		h.mu.Unlock()
+		report := runChecks(checks)
+		h.cached = &report
+	}
+	report := *h.cached
+	h.running.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, name := range h.consumers {
+		status := ConsumerStatus{Name: name}
+		if last, ok := h.polls[name]; ok {
+			since := time.Since(last).Milliseconds()
+			status.LastPoll = &last
+			status.SinceLastPollMs = &since
+		}
+		report.Consumers = append(report.Consumers, status)
+	}
+	return report
+}
+
+func runChecks(checks []healthCheck) ReadinessReport {
+	report := ReadinessReport{
+		Status:       "ok",
+		CheckedAt:    time.Now().UTC(),
+		Dependencies: make([]DependencyStatus, len(checks)),
+	}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := check.check(ctx)
+			status := DependencyStatus{
+				Name:      check.name,
+				Status:    "ok",
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				status.Status = "down"
+				status.Error = err.Error()
+			}
+			report.Dependencies[i] = status
+		}(i, check)
+	}
+	wg.Wait()
+	for _, dependency := range report.Dependencies {
+		if dependency.Status != "ok" {
+			report.Status = "unavailable"
+		}
+	}
+	return report
+}
+
+// Livez serves GET /livez: the process is up and serving, whatever the state
+// of its dependencies.
+func Livez(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// Readyz serves GET /readyz from Default: 200 when every dependency is
+// usable, 503 with the same report otherwise.
+func Readyz(w http.ResponseWriter, _ *http.Request) {
+	report := Default.Report()
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -1,6 +1,6 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
-// 	protoc-gen-go v1.36.4
+// 	protoc-gen-go v1.36.6
 // 	protoc        v5.28.1
 // source: ipinfo.proto
 
@@ -69,6 +69,7 @@ type IpResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Ip            string                 `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
 	Info          string                 `protobuf:"bytes,2,opt,name=info,proto3" json:"info,omitempty"`
+	Tags          []string               `protobuf:"bytes,3,rep,name=tags,proto3" json:"tags,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -117,25 +118,27 @@ func (x *IpResponse) GetInfo() string {
 	return ""
 }
 
+func (x *IpResponse) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
 var File_ipinfo_proto protoreflect.FileDescriptor
 
-var file_ipinfo_proto_rawDesc = string([]byte{
-	0x0a, 0x0c, 0x69, 0x70, 0x69, 0x6e, 0x66, 0x6f, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x06,
-	0x69, 0x70, 0x69, 0x6e, 0x66, 0x6f, 0x22, 0x1b, 0x0a, 0x09, 0x49, 0x70, 0x52, 0x65, 0x71, 0x75,
-	0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x02, 0x69, 0x70, 0x22, 0x30, 0x0a, 0x0a, 0x49, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
-	0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69,
-	0x70, 0x12, 0x12, 0x0a, 0x04, 0x69, 0x6e, 0x66, 0x6f, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x04, 0x69, 0x6e, 0x66, 0x6f, 0x32, 0x43, 0x0a, 0x0d, 0x49, 0x70, 0x49, 0x6e, 0x66, 0x6f, 0x53,
-	0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x32, 0x0a, 0x09, 0x47, 0x65, 0x74, 0x49, 0x70, 0x49,
-	0x6e, 0x66, 0x6f, 0x12, 0x11, 0x2e, 0x69, 0x70, 0x69, 0x6e, 0x66, 0x6f, 0x2e, 0x49, 0x70, 0x52,
-	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x12, 0x2e, 0x69, 0x70, 0x69, 0x6e, 0x66, 0x6f, 0x2e,
-	0x49, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x2d, 0x5a, 0x2b, 0x67, 0x69,
-	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6d, 0x65, 0x74, 0x61, 0x6c, 0x62, 0x65,
-	0x61, 0x72, 0x2d, 0x63, 0x6f, 0x2f, 0x70, 0x6c, 0x61, 0x79, 0x67, 0x72, 0x6f, 0x75, 0x6e, 0x64,
-	0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x67, 0x65, 0x6e, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f,
-	0x33,
-})
+const file_ipinfo_proto_rawDesc = "" +
+	"\n" +
+	"\fipinfo.proto\x12\x06ipinfo\"\x1b\n" +
+	"\tIpRequest\x12\x0e\n" +
+	"\x02ip\x18\x01 \x01(\tR\x02ip\"D\n" +
+	"\n" +
+	"IpResponse\x12\x0e\n" +
+	"\x02ip\x18\x01 \x01(\tR\x02ip\x12\x12\n" +
+	"\x04info\x18\x02 \x01(\tR\x04info\x12\x12\n" +
+	"\x04tags\x18\x03 \x03(\tR\x04tags2C\n" +
+	"\rIpInfoService\x122\n" +
+	"\tGetIpInfo\x12\x11.ipinfo.IpRequest\x1a\x12.ipinfo.IpResponseB-Z+github.com/metalbear-co/playground/protogenb\x06proto3"
 
 var (
 	file_ipinfo_proto_rawDescOnce sync.Once